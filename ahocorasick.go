@@ -0,0 +1,173 @@
+package filter
+
+// MatchKind selects how overlapping matches between targets are resolved.
+// In both modes the match that starts earliest in the stream always wins;
+// the kinds differ in how they choose between targets matching at the same
+// position.
+type MatchKind int
+
+const (
+	// LeftmostLongest prefers the longest target matching at a position.
+	LeftmostLongest MatchKind = iota
+	// LeftmostFirst prefers the target listed first among those matching at
+	// a position, which lets callers express priorities between targets.
+	LeftmostFirst
+)
+
+// automaton is an Aho-Corasick automaton over a set of targets. It is
+// immutable once built and is shared by the read and write sides of a
+// filter; per-stream state lives in acStream.
+type automaton struct {
+	kind    MatchKind
+	targets [][]byte
+	// classes maps each byte to its equivalence class. Bytes that occur in
+	// no target share class 0, which keeps the transition table small.
+	classes  [256]uint16
+	nclasses int
+	// delta is the dense transition table, indexed by state*nclasses+class.
+	delta []int32
+	depth []int32
+	// out holds the index of the longest target ending at each state, or -1.
+	out []int32
+}
+
+// newAutomaton compiles targets into a deterministic automaton. Targets must
+// be non-empty.
+func newAutomaton(targets [][]byte, kind MatchKind) *automaton {
+	a := &automaton{kind: kind, targets: targets}
+	for _, t := range targets {
+		for _, c := range t {
+			if a.classes[c] == 0 {
+				a.nclasses++
+				a.classes[c] = uint16(a.nclasses)
+			}
+		}
+	}
+	a.nclasses++
+
+	// Build the trie, using -1 for missing edges.
+	a.newState(0)
+	for i, t := range targets {
+		s := int32(0)
+		for _, c := range t {
+			idx := int(s)*a.nclasses + int(a.classes[c])
+			if a.delta[idx] < 0 {
+				a.delta[idx] = a.newState(a.depth[s] + 1)
+			}
+			s = a.delta[idx]
+		}
+		if a.out[s] < 0 {
+			a.out[s] = int32(i)
+		}
+	}
+
+	// Fill in failure transitions breadth first, turning the trie into a DFA.
+	fail := make([]int32, len(a.depth))
+	queue := make([]int32, 0, len(a.depth))
+	for cls := 0; cls < a.nclasses; cls++ {
+		if next := a.delta[cls]; next < 0 {
+			a.delta[cls] = 0
+		} else {
+			queue = append(queue, next)
+		}
+	}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		if a.out[s] < 0 {
+			a.out[s] = a.out[fail[s]]
+		}
+		for cls := 0; cls < a.nclasses; cls++ {
+			idx := int(s)*a.nclasses + cls
+			fallback := a.delta[int(fail[s])*a.nclasses+cls]
+			if next := a.delta[idx]; next < 0 {
+				a.delta[idx] = fallback
+			} else {
+				fail[next] = fallback
+				queue = append(queue, next)
+			}
+		}
+	}
+	return a
+}
+
+func (a *automaton) newState(depth int32) int32 {
+	for i := 0; i < a.nclasses; i++ {
+		a.delta = append(a.delta, -1)
+	}
+	a.depth = append(a.depth, depth)
+	a.out = append(a.out, -1)
+	return int32(len(a.depth) - 1)
+}
+
+// match is a candidate occurrence of targets[target] at data[start:end].
+type match struct {
+	target     int
+	start, end int
+}
+
+// better reports whether m should replace the current best candidate.
+func (a *automaton) better(m, best match) bool {
+	if best.target < 0 || m.start < best.start {
+		return true
+	}
+	if m.start > best.start {
+		return false
+	}
+	if a.kind == LeftmostFirst {
+		return m.target < best.target
+	}
+	return m.end > best.end
+}
+
+// acStream replaces the targets of an automaton in a byte stream. Input
+// that could still be part of a match is carried over between calls.
+type acStream struct {
+	a            *automaton
+	replacements [][]byte
+	carry        []byte
+}
+
+// transform implements transformer.
+func (s *acStream) transform(b []byte, final bool) ([]byte, error) {
+	a := s.a
+	data := append(s.carry, b...)
+	out := make([]byte, 0, len(data))
+	emitted := 0
+	for {
+		state := int32(0)
+		best := match{target: -1}
+		i := emitted
+		for ; i < len(data); i++ {
+			state = a.delta[int(state)*a.nclasses+int(a.classes[data[i]])]
+			if t := a.out[state]; t >= 0 {
+				m := match{target: int(t), start: i + 1 - len(a.targets[t]), end: i + 1}
+				if a.better(m, best) {
+					best = m
+				}
+			}
+			// No match found later can start at or before best.start once the
+			// automaton no longer tracks a prefix reaching back that far.
+			if best.target >= 0 && best.start < i+1-int(a.depth[state]) {
+				break
+			}
+		}
+		if best.target < 0 || (i == len(data) && !final) {
+			// Without a match everything up to the prefix the automaton is
+			// tracking is final. An unconfirmed candidate might still be
+			// beaten by more input, so it is carried over as well.
+			keep := len(data)
+			if !final {
+				keep = i - int(a.depth[state])
+			}
+			out = append(out, data[emitted:keep]...)
+			emitted = keep
+			break
+		}
+		out = append(out, data[emitted:best.start]...)
+		out = append(out, s.replacements[best.target]...)
+		emitted = best.end
+	}
+	s.carry = append(s.carry[:0], data[emitted:]...)
+	return out, nil
+}
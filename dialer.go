@@ -0,0 +1,46 @@
+package filter
+
+import (
+	"context"
+	"net"
+)
+
+// Dialer dials outbound connections and passes each through a factory, typically one that
+// wraps the connection in a filter, so that filters apply to connections we originate.
+type Dialer struct {
+	dial    func(ctx context.Context, network, address string) (net.Conn, error)
+	factory func(net.Conn) (net.Conn, error)
+}
+
+// NewDialer creates a Dialer that dials with dial and wraps each connection using factory.
+// dial may be the DialContext method of a net.Dialer or any function with the same signature;
+// if it is nil a zero net.Dialer is used.
+func NewDialer(dial func(ctx context.Context, network, address string) (net.Conn, error), factory func(net.Conn) (net.Conn, error)) *Dialer {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return &Dialer{
+		dial:    dial,
+		factory: factory,
+	}
+}
+
+// Dial connects to the address on the named network and wraps the connection.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network using the provided context and
+// wraps the connection. If the factory returns an error the connection is closed.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	filtered, err := d.factory(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return filtered, nil
+}
@@ -0,0 +1,40 @@
+package filter
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		data, _ := io.ReadAll(c)
+		received <- string(data)
+		c.Close()
+	}()
+
+	d := NewDialer(nil, func(c net.Conn) (net.Conn, error) {
+		return NewConnFilter(c, []string{"internal.lan"}, []string{"example.i2p"})
+	})
+	conn, err := d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("Host: internal.lan")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := <-received; got != "Host: example.i2p" {
+		t.Errorf("server received %q", got)
+	}
+}
@@ -1,58 +1,94 @@
 package filter
 
 import (
-	"bytes"
 	"errors"
 	"net"
+	"sync"
 )
 
-var ErrInvalidFilter = errors.New("target and replacement must have the same length")
+var (
+	ErrInvalidFilter = errors.New("target and replacement must have the same length")
+	ErrEmptyTarget   = errors.New("target must not be empty")
+)
 
 type ConnFilter struct {
 	net.Conn
 	targets      []string
 	replacements []string
+	reader       streamReader
+	writer       *acStream
+	writeMu      sync.Mutex
 }
 
 // Read reads data from the underlying connection and replaces all occurrences of target strings
-// with their corresponding replacement strings. The replacements are made sequentially for each
-// target-replacement pair. The modified data is then copied back to the provided buffer.
+// with their corresponding replacement strings. Matching is streaming: a target split across
+// several reads of the underlying connection is still replaced, because bytes that may be the
+// start of a target are held back until enough data has arrived to decide. Replacements that do
+// not fit in b are delivered by subsequent calls to Read.
 func (c *ConnFilter) Read(b []byte) (n int, err error) {
-	n, err = c.Conn.Read(b)
-	if err != nil {
-		return n, err
-	}
+	return c.reader.Read(b)
+}
 
-	// Replace all occurrences of target with replacement
-	var buffer bytes.Buffer
-	buffer.Write(b[:n])
-	for i := range c.targets {
-		buffer.Reset()
-		buffer.Write(bytes.ReplaceAll(b[:n], []byte(c.targets[i]), []byte(c.replacements[i])))
-	}
-	copy(b, buffer.Bytes())
-	return buffer.Len(), nil
+// drain implements drainer.
+func (c *ConnFilter) drain() ([]byte, error) {
+	return c.reader.drain()
 }
 
 // Write writes the data to the underlying connection after replacing all occurrences of target strings
-// with their corresponding replacement strings. The replacements are made sequentially for each
-// target-replacement pair.
+// with their corresponding replacement strings. Each call is filtered on its own, so that no bytes are
+// held back waiting for a following Write. It returns the number of bytes consumed from b.
 func (c *ConnFilter) Write(b []byte) (n int, err error) {
-	for i := range c.targets {
-		b = bytes.ReplaceAll(b, []byte(c.targets[i]), []byte(c.replacements[i]))
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	out, err := c.writer.transform(b, true)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
 	}
-	return c.Conn.Write(b)
+	return len(b), nil
 }
 
 // NewConnFilter creates a new ConnFilter that replaces occurrences of target strings with replacement strings in the data read from the connection.
-// It returns an error if the lengths of target and replacement slices are not equal.
-func NewConnFilter(parentConn net.Conn, targets, replacements []string) (net.Conn, error) {
+// The targets are compiled into a single Aho-Corasick automaton, so each byte is scanned once however many targets there are.
+// Where several targets match at the same position the longest one wins, unless another MatchKind is chosen with WithMatchKind.
+// It returns an error if the lengths of target and replacement slices are not equal, or if any target is empty.
+func NewConnFilter(parentConn net.Conn, targets, replacements []string, opts ...Option) (net.Conn, error) {
+	factory, err := connFilterFactory(targets, replacements, opts)
+	if err != nil {
+		return nil, err
+	}
+	return factory(parentConn)
+}
+
+// connFilterFactory validates and compiles the targets once, returning a function that wraps
+// connections in ConnFilters sharing the compiled automaton.
+func connFilterFactory(targets, replacements []string, opts []Option) (func(net.Conn) (net.Conn, error), error) {
 	if len(targets) != len(replacements) {
 		return nil, ErrInvalidFilter
 	}
-	return &ConnFilter{
-		Conn:         parentConn,
-		targets:      targets,
-		replacements: replacements,
+	for _, target := range targets {
+		if target == "" {
+			return nil, ErrEmptyTarget
+		}
+	}
+	o := newOptions(opts)
+	t := make([][]byte, len(targets))
+	r := make([][]byte, len(replacements))
+	for i := range targets {
+		t[i] = []byte(targets[i])
+		r[i] = []byte(replacements[i])
+	}
+	a := newAutomaton(t, o.matchKind)
+	return func(parentConn net.Conn) (net.Conn, error) {
+		c := &ConnFilter{
+			Conn:         parentConn,
+			targets:      targets,
+			replacements: replacements,
+			writer:       &acStream{a: a, replacements: r},
+		}
+		c.reader = streamReader{r: parentConn, t: &acStream{a: a, replacements: r}}
+		return c, nil
 	}, nil
 }
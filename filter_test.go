@@ -0,0 +1,268 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnFilterSplitTargets(t *testing.T) {
+	tests := []struct {
+		name         string
+		chunks       []string
+		targets      []string
+		replacements []string
+		bufSize      int
+		want         string
+	}{
+		{
+			name:         "target split across reads",
+			chunks:       []string{"GET http://hostna", "me.i2p/ HTTP/1.1"},
+			targets:      []string{"hostname.i2p"},
+			replacements: []string{"example.i2p"},
+			bufSize:      64,
+			want:         "GET http://example.i2p/ HTTP/1.1",
+		},
+		{
+			name:         "every pair is applied",
+			chunks:       []string{"alice@10.0.0", ".1 bob"},
+			targets:      []string{"alice", "10.0.0.1", "bob"},
+			replacements: []string{"user", "x.x.x.x", "user"},
+			bufSize:      64,
+			want:         "user@x.x.x.x user",
+		},
+		{
+			name:         "replacement longer than buffer",
+			chunks:       []string{"a", "b"},
+			targets:      []string{"a"},
+			replacements: []string{"0123456789"},
+			bufSize:      3,
+			want:         "0123456789b",
+		},
+		{
+			name:         "unfinished prefix flushed at EOF",
+			chunks:       []string{"host", "na"},
+			targets:      []string{"hostname.i2p"},
+			replacements: []string{"x"},
+			bufSize:      64,
+			want:         "hostna",
+		},
+		{
+			name:         "longest target wins",
+			chunks:       []string{"ab", "cd"},
+			targets:      []string{"ab", "abcd"},
+			replacements: []string{"1", "2"},
+			bufSize:      64,
+			want:         "2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := NewConnFilter(&chunkConn{chunks: tt.chunks}, tt.targets, tt.replacements)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := readAll(conn, tt.bufSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnFilterMatchKind(t *testing.T) {
+	targets := []string{"ab", "abcd", "bc"}
+	replacements := []string{"1", "2", "3"}
+	tests := []struct {
+		kind MatchKind
+		want string
+	}{
+		{LeftmostLongest, "2-2"},
+		{LeftmostFirst, "1cd-1cd"},
+	}
+	for _, tt := range tests {
+		conn, err := NewConnFilter(&chunkConn{chunks: []string{"abcd-a", "bcd"}}, targets, replacements, WithMatchKind(tt.kind))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readAll(conn, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("kind %d: got %q, want %q", tt.kind, got, tt.want)
+		}
+	}
+}
+
+// TestConnFilterRandomSplits compares the streaming automaton against a naive
+// single-pass replacement over random inputs split at random points.
+func TestConnFilterRandomSplits(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randString := func(n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = "abc"[rng.Intn(3)]
+		}
+		return string(b)
+	}
+	for iter := 0; iter < 500; iter++ {
+		var targets, replacements []string
+		for i := 0; i < 1+rng.Intn(5); i++ {
+			targets = append(targets, randString(1+rng.Intn(4)))
+			replacements = append(replacements, fmt.Sprintf("<%d>", i))
+		}
+		input := randString(rng.Intn(40))
+		var chunks []string
+		for rest := input; rest != ""; {
+			n := 1 + rng.Intn(len(rest))
+			chunks = append(chunks, rest[:n])
+			rest = rest[n:]
+		}
+		for _, kind := range []MatchKind{LeftmostLongest, LeftmostFirst} {
+			conn, err := NewConnFilter(&chunkConn{chunks: append([]string(nil), chunks...)}, targets, replacements, WithMatchKind(kind))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := readAll(conn, 1+rng.Intn(8))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := naiveReplace(input, targets, replacements, kind); got != want {
+				t.Fatalf("kind %d, targets %q, chunks %q: got %q, want %q", kind, targets, chunks, got, want)
+			}
+		}
+	}
+}
+
+// naiveReplace replaces targets by trying every target at every position.
+func naiveReplace(s string, targets, replacements []string, kind MatchKind) string {
+	var out strings.Builder
+	for i := 0; i < len(s); {
+		best := -1
+		for j, target := range targets {
+			if !strings.HasPrefix(s[i:], target) {
+				continue
+			}
+			if best < 0 || (kind == LeftmostLongest && len(target) > len(targets[best])) {
+				best = j
+			}
+		}
+		if best < 0 {
+			out.WriteByte(s[i])
+			i++
+			continue
+		}
+		out.WriteString(replacements[best])
+		i += len(targets[best])
+	}
+	return out.String()
+}
+
+func BenchmarkConnFilter(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	payload := make([]byte, 1<<20)
+	for i := range payload {
+		payload[i] = byte('a' + rng.Intn(26))
+	}
+	for _, count := range []int{10, 1000, 5000} {
+		targets := make([]string, count)
+		replacements := make([]string, count)
+		for i := range targets {
+			targets[i] = fmt.Sprintf("host%d.internal.i2p", i)
+			replacements[i] = "redacted.i2p"
+		}
+		for _, kind := range []MatchKind{LeftmostLongest, LeftmostFirst} {
+			b.Run(fmt.Sprintf("targets=%d/kind=%d", count, kind), func(b *testing.B) {
+				b.SetBytes(int64(len(payload)))
+				for i := 0; i < b.N; i++ {
+					conn, err := NewConnFilter(&chunkConn{chunks: []string{string(payload)}}, targets, replacements, WithMatchKind(kind))
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := io.Copy(io.Discard, conn); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestConnFilterWrite(t *testing.T) {
+	parent := &chunkConn{}
+	conn, err := NewConnFilter(parent, []string{"secret"}, []string{"[redacted]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := conn.Write([]byte("a secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len("a secret") {
+		t.Errorf("Write returned %d, want %d", n, len("a secret"))
+	}
+	if got := parent.written.String(); got != "a [redacted]" {
+		t.Errorf("wrote %q", got)
+	}
+}
+
+// readAll reads conn until EOF using a buffer of the given size.
+func readAll(conn net.Conn, size int) (string, error) {
+	var out bytes.Buffer
+	buf := make([]byte, size)
+	for {
+		n, err := conn.Read(buf)
+		out.Write(buf[:n])
+		if err == io.EOF {
+			return out.String(), nil
+		}
+		if err != nil {
+			return out.String(), err
+		}
+	}
+}
+
+// chunkConn is a net.Conn that returns each chunk from a separate Read and records writes.
+type chunkConn struct {
+	chunks  []string
+	written bytes.Buffer
+}
+
+func (c *chunkConn) Read(b []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.chunks[0])
+	c.chunks[0] = c.chunks[0][n:]
+	if c.chunks[0] == "" {
+		c.chunks = c.chunks[1:]
+	}
+	return n, nil
+}
+
+func (c *chunkConn) Write(b []byte) (int, error) { return c.written.Write(b) }
+
+func (c *chunkConn) Close() error { return nil }
+
+func (c *chunkConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+}
+
+func (c *chunkConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+}
+
+func (c *chunkConn) SetDeadline(t time.Time) error { return nil }
+
+func (c *chunkConn) SetReadDeadline(t time.Time) error { return nil }
+
+func (c *chunkConn) SetWriteDeadline(t time.Time) error { return nil }
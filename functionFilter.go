@@ -19,31 +19,64 @@ type FunctionConnFilter struct {
 	net.Conn
 	ReadFilter  func(b []byte) ([]byte, error)
 	WriteFilter func(b []byte) ([]byte, error)
+	reader      *streamReader
 }
 
 var ex net.Conn = &FunctionConnFilter{}
 
-// Write modifies the bytes according to c.Filter and writes the result to the underlying connection
+// Write modifies the bytes according to c.WriteFilter and writes the result to the underlying connection.
+// As required of an io.Writer, it returns the number of bytes consumed from b, whatever the length of the
+// filtered data; on error no bytes are reported as consumed.
 func (c *FunctionConnFilter) Write(b []byte) (n int, err error) {
-	b2, err := c.WriteFilter(b)
+	writeFilter := c.WriteFilter
+	if writeFilter == nil {
+		writeFilter = noopWriteFilter
+	}
+	b2, err := writeFilter(b)
 	if err != nil {
 		return 0, err
 	}
-	return c.Conn.Write(b2)
+	if _, err := c.Conn.Write(b2); err != nil {
+		return 0, err
+	}
+	return len(b), nil
 }
 
-// Read reads data from the underlying connection and modifies the bytes according to c.Filter
+// Read reads data from the underlying connection and modifies the bytes according to c.ReadFilter.
+// Filtered data that does not fit in b is kept and delivered by subsequent calls to Read, and chunks
+// the filter removes entirely are skipped rather than reported as empty reads.
 func (c *FunctionConnFilter) Read(b []byte) (n int, err error) {
-	n, err = c.Conn.Read(b)
-	if err != nil {
-		return 0, err
+	if c.reader == nil {
+		c.reader = &streamReader{r: c.Conn, t: filterFunc(c.readFilter)}
 	}
-	b2, err := c.ReadFilter(b[:n])
-	if err != nil {
-		return 0, err
+	return c.reader.Read(b)
+}
+
+// drain implements drainer.
+func (c *FunctionConnFilter) drain() ([]byte, error) {
+	if c.reader == nil {
+		return nil, nil
+	}
+	return c.reader.drain()
+}
+
+// readFilter calls c.ReadFilter, which may be replaced after the filter is created.
+func (c *FunctionConnFilter) readFilter(b []byte) ([]byte, error) {
+	if c.ReadFilter == nil {
+		return noopReadFilter(b)
+	}
+	return c.ReadFilter(b)
+}
+
+// filterFunc adapts a function that filters independent chunks to a transformer.
+type filterFunc func(b []byte) ([]byte, error)
+
+// transform implements transformer.
+func (f filterFunc) transform(b []byte, final bool) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, nil
 	}
-	copy(b, b2)
-	return len(b2), nil
+	return f(b)
 }
 
 // NewFunctionConnFilter creates a new FunctionConnFilter that has the powerful ability to rewrite any byte that comes across the net.Conn with user-defined functions. By default, the filters are no-op functions.
@@ -0,0 +1,92 @@
+package filter
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestFunctionConnFilter(t *testing.T) {
+	double := func(b []byte) ([]byte, error) {
+		out := make([]byte, 0, 2*len(b))
+		for _, c := range b {
+			out = append(out, c, c)
+		}
+		return out, nil
+	}
+	dropVowels := func(b []byte) ([]byte, error) {
+		return bytes.Map(func(r rune) rune {
+			if bytes.ContainsRune([]byte("aeiou"), r) {
+				return -1
+			}
+			return r
+		}, b), nil
+	}
+	dropAll := func(b []byte) ([]byte, error) {
+		return nil, nil
+	}
+	tests := []struct {
+		name    string
+		filter  func(b []byte) ([]byte, error)
+		chunks  []string
+		bufSize int
+		want    string
+	}{
+		{"nil filter", nil, []string{"hello", " world"}, 4, "hello world"},
+		{"expanding", double, []string{"abc", "de"}, 4, "aabbccddee"},
+		{"expanding into one-byte reads", double, []string{"abc"}, 1, "aabbcc"},
+		{"shrinking", dropVowels, []string{"education", "aeiou", "x"}, 3, "dctnx"},
+		{"empty output", dropAll, []string{"abc", "def"}, 4, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/read", func(t *testing.T) {
+			conn, err := NewFunctionConnFilter(&chunkConn{chunks: append([]string(nil), tt.chunks...)}, tt.filter, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := readAll(conn, tt.bufSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+		})
+		t.Run(tt.name+"/write", func(t *testing.T) {
+			parent := &chunkConn{}
+			conn, err := NewFunctionConnFilter(parent, nil, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, chunk := range tt.chunks {
+				n, err := conn.Write([]byte(chunk))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != len(chunk) {
+					t.Errorf("Write(%q) returned %d, want %d", chunk, n, len(chunk))
+				}
+			}
+			if got := parent.written.String(); got != tt.want {
+				t.Errorf("wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFunctionConnFilterError(t *testing.T) {
+	errRejected := errors.New("rejected")
+	reject := func(b []byte) ([]byte, error) {
+		return nil, errRejected
+	}
+	conn, err := NewFunctionConnFilter(&chunkConn{chunks: []string{"abc"}}, reject, reject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := conn.Read(make([]byte, 8)); n != 0 || !errors.Is(err, errRejected) {
+		t.Errorf("Read returned %d, %v", n, err)
+	}
+	if n, err := conn.Write([]byte("abc")); n != 0 || !errors.Is(err, errRejected) {
+		t.Errorf("Write returned %d, %v", n, err)
+	}
+}
@@ -1,3 +1,12 @@
 module github.com/go-i2p/go-connfilter
 
 go 1.23.5
+
+require gopkg.in/yaml.v3 v3.0.1
+
+require (
+	github.com/andybalholm/brotli v1.2.0
+	golang.org/x/net v0.38.0
+)
+
+require golang.org/x/text v0.23.0 // indirect
@@ -0,0 +1,308 @@
+package httpinspector
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// readBufferSize is the size of the buffer used to read from the underlying
+// connection.
+const readBufferSize = 32 * 1024
+
+// inspectedConn wraps a net.Conn to provide HTTP inspection. On accepted
+// connections requests are read and responses written; on dialed (client)
+// connections the directions are reversed.
+type inspectedConn struct {
+	net.Conn
+	config  Config
+	client  bool
+	methods methodSet
+	id      uint64 // Identifies the connection in its exchanges
+
+	readMu  sync.Mutex
+	reads   *messageStream
+	rbuf    []byte
+	pending []byte
+	readErr error
+
+	writeMu sync.Mutex
+	writes  *messageStream
+
+	mu           sync.Mutex
+	queue        []*queuedRequest   // Requests awaiting a response, oldest first
+	pumps        map[*bodyPump]bool // Body transformers that are running
+	readDeadline time.Time          // The read deadline set by the user
+	woken        bool               // The read deadline was moved to interrupt Read
+	switching    switchState        // Progress of a request that may switch protocols
+	switchReq    *http.Request      // The request that may switch protocols
+	raw          *rawConn           // The underlying connection as seen by the tunnel
+	tunnel       net.Conn           // The tunnel inspector that took the connection over
+	h2           *http2Conn         // The state of an HTTP/2 connection
+	h2Streams    [2]*http2Stream    // Its streams carrying requests and responses
+	sequence     uint64             // Number of requests seen
+}
+
+// queuedRequest is a request awaiting its response. The inspector answers a
+// rejected request itself, with the response in reject.
+type queuedRequest struct {
+	req    *http.Request
+	reject []byte
+	close  bool
+}
+
+func newInspectedConn(conn net.Conn, config Config, client bool) *inspectedConn {
+	c := &inspectedConn{
+		Conn:    conn,
+		config:  config,
+		client:  client,
+		methods: newMethodSet(config.ExtensionMethods),
+		id:      connIDs.Add(1),
+	}
+	c.reads = &messageStream{conn: c, requests: !client}
+	c.writes = &messageStream{conn: c, requests: client}
+	return c
+}
+
+// Read implements the net.Conn Read method with HTTP inspection. Messages
+// that do not fit in b are delivered by subsequent calls.
+func (c *inspectedConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		if c.reads.state == stateTunnel {
+			return c.tunnel.Read(b)
+		}
+		if c.readErr != nil {
+			err := c.readErr
+			c.readErr = nil
+			return 0, err
+		}
+		if c.rbuf == nil {
+			c.rbuf = make([]byte, readBufferSize)
+		}
+		n, err := c.Conn.Read(c.rbuf)
+		if c.unwake() && errors.Is(err, os.ErrDeadlineExceeded) {
+			// Interrupted by wake, to go on with bytes already read.
+			err = nil
+		}
+		out, perr := c.reads.feed(c.rbuf[:n], err == io.EOF)
+		c.pending = append(c.pending, out...)
+		if c.reads.state == stateTunnel {
+			// Bytes past the HTTP messages belong to the tunnel.
+			c.raw.unread(c.reads.take())
+		}
+		if perr != nil {
+			err = perr
+		}
+		if err == nil && c.reads.state == stateClosed {
+			err = io.EOF
+		}
+		c.readErr = err
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write implements the net.Conn Write method with HTTP inspection. Partial
+// messages are held until enough of them has been written to inspect; it
+// returns the number of bytes consumed from b.
+func (c *inspectedConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	switch c.writes.state {
+	case stateTunnel:
+		return c.tunnel.Write(b)
+	case stateClosed:
+		// The connection is closing after a rejected request.
+		return len(b), nil
+	}
+	if err := c.writeThrough(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeThrough passes b through the written stream and writes the output.
+// Bytes that follow a switch to a tunnel are written through the tunnel.
+// It must be called with writeMu held.
+func (c *inspectedConn) writeThrough(b []byte) error {
+	out, err := c.writes.feed(b, false)
+	if len(out) > 0 {
+		if _, werr := c.Conn.Write(out); werr != nil {
+			return werr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if c.writes.state == stateTunnel {
+		if rest := c.writes.take(); len(rest) > 0 {
+			if _, err := c.tunnel.Write(rest); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close implements the net.Conn Close method. The end of the written stream
+// completes a response delimited by the connection closing, which is written
+// out before the underlying connection (or the tunnel that took it over) is
+// closed. Close does not wait for a
+// Write in progress, since closing may be what unblocks it. Body transformers
+// still running see the end of their input.
+func (c *inspectedConn) Close() error {
+	c.mu.Lock()
+	for p := range c.pumps {
+		p.abort()
+	}
+	tunnel := c.tunnel
+	c.mu.Unlock()
+	if c.writeMu.TryLock() {
+		out, _ := c.writes.feed(nil, true)
+		if len(out) > 0 {
+			c.Conn.Write(out)
+		}
+		c.writeMu.Unlock()
+	}
+	if tunnel != nil {
+		return tunnel.Close()
+	}
+	return c.Conn.Close()
+}
+
+// SetDeadline implements the net.Conn SetDeadline method.
+func (c *inspectedConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if c.woken {
+		return c.Conn.SetWriteDeadline(t)
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements the net.Conn SetReadDeadline method.
+func (c *inspectedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if c.woken {
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// wake interrupts a Read blocked on the underlying connection by moving its
+// read deadline into the past.
+func (c *inspectedConn) wake() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.woken = true
+	c.Conn.SetReadDeadline(time.Unix(1, 0))
+}
+
+// unwake restores the read deadline after wake, reporting whether Read was
+// interrupted.
+func (c *inspectedConn) unwake() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.woken {
+		return false
+	}
+	c.woken = false
+	c.Conn.SetReadDeadline(c.readDeadline)
+	return true
+}
+
+// pushRequest records a request whose response has yet to be seen.
+func (c *inspectedConn) pushRequest(req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queue = append(c.queue, &queuedRequest{req: req})
+}
+
+// nextRequest returns the oldest request awaiting a response, removing it
+// if pop is set. It returns nil if no request is outstanding, or if the
+// oldest one is answered by the inspector.
+func (c *inspectedConn) nextRequest(pop bool) *http.Request {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.queue) == 0 || c.queue[0].reject != nil {
+		return nil
+	}
+	req := c.queue[0].req
+	if pop {
+		c.queue = c.queue[1:]
+	}
+	return req
+}
+
+// rejectRequest arranges for the inspector to answer req with response,
+// once the responses to any earlier requests have been sent.
+func (c *inspectedConn) rejectRequest(req *http.Request, response []byte, close bool) {
+	c.mu.Lock()
+	for _, e := range c.queue {
+		if e.req == req {
+			e.reject, e.close = response, close
+		}
+	}
+	c.mu.Unlock()
+
+	if c.client {
+		// The response is read from this side of the connection.
+		c.wake()
+		return
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writes.idle() {
+		if out := c.writes.appendRejections(nil); len(out) > 0 {
+			c.Conn.Write(out)
+		}
+	}
+}
+
+// popRejections removes the rejected requests at the front of the queue and
+// returns the responses answering them, and whether the connection closes
+// after them.
+func (c *inspectedConn) popRejections() (out []byte, close bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.queue) > 0 && c.queue[0].reject != nil {
+		e := c.queue[0]
+		c.queue = c.queue[1:]
+		out = append(out, e.reject...)
+		if e.close {
+			c.queue = nil
+			return out, true
+		}
+	}
+	return out, false
+}
+
+// addPump records a running body transformer.
+func (c *inspectedConn) addPump(p *bodyPump) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pumps == nil {
+		c.pumps = make(map[*bodyPump]bool)
+	}
+	c.pumps[p] = true
+}
+
+// removePump forgets a body transformer whose input has ended.
+func (c *inspectedConn) removePump(p *bodyPump) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pumps, p)
+}
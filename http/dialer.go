@@ -0,0 +1,45 @@
+package httpinspector
+
+import (
+	"context"
+	"net"
+)
+
+// Dialer dials outbound connections with HTTP inspection. The same Config
+// callbacks as an Inspector's apply, with the directions reversed: OnRequest
+// is called for requests written to the connection and OnResponse for
+// responses read from it. Its DialContext method can be used as the
+// DialContext of an http.Transport.
+type Dialer struct {
+	dial   func(ctx context.Context, network, address string) (net.Conn, error)
+	config Config
+}
+
+// NewDialer creates a Dialer that dials with dial, which may be the
+// DialContext method of a net.Dialer or any function with the same
+// signature. If dial is nil a zero net.Dialer is used.
+func NewDialer(dial func(ctx context.Context, network, address string) (net.Conn, error), config Config) *Dialer {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return &Dialer{
+		dial:   dial,
+		config: config,
+	}
+}
+
+// Dial connects to the address on the named network.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network using the
+// provided context.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return newInspectedConn(conn, d.config, true), nil
+}
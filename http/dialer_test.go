@@ -0,0 +1,67 @@
+package httpinspector
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDialer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Modified"))
+	}))
+	defer server.Close()
+
+	dialer := NewDialer(nil, Config{
+		OnRequest: func(req *http.Request) error {
+			req.Header.Set("X-Modified", "request")
+			return nil
+		},
+		OnResponse: func(resp *http.Response) error {
+			resp.Header.Set("X-Modified", "response")
+			return nil
+		},
+	})
+	client := &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "request" {
+		t.Errorf("server saw X-Modified %q", body)
+	}
+	if got := resp.Header.Get("X-Modified"); got != "response" {
+		t.Errorf("client saw X-Modified %q", got)
+	}
+}
+
+func TestDialerReject(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("server saw %s", r.URL.Path)
+	}))
+	defer server.Close()
+
+	dialer := NewDialer(nil, Config{OnRequest: func(req *http.Request) error {
+		return &Reject{Status: http.StatusForbidden, Body: []byte("no")}
+	}})
+	client := &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL + "/blocked")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden || string(body) != "no" {
+			t.Errorf("got %s %q", resp.Status, body)
+		}
+	}
+}
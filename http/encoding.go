@@ -0,0 +1,287 @@
+package httpinspector
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// contentCodings returns the content codings applied to a message with
+// header h, in the order they were applied.
+func contentCodings(h http.Header) []string {
+	var codings []string
+	for _, v := range h.Values("Content-Encoding") {
+		for _, c := range strings.Split(v, ",") {
+			c = strings.ToLower(strings.TrimSpace(c))
+			if c != "" && c != "identity" {
+				codings = append(codings, c)
+			}
+		}
+	}
+	return codings
+}
+
+// contentCoding returns the content coding of a message with header h,
+// provided it is a single coding the inspector can decode: gzip, deflate or
+// br. ok is false if the body is not encoded, or not in a way it can decode.
+func contentCoding(h http.Header) (coding string, ok bool) {
+	codings := contentCodings(h)
+	if len(codings) != 1 {
+		return "", false
+	}
+	switch codings[0] {
+	case "gzip", "x-gzip":
+		return "gzip", true
+	case "deflate", "br":
+		return codings[0], true
+	}
+	return "", false
+}
+
+// newDecoder returns a reader decoding r, encoded with coding.
+func newDecoder(coding string, r io.Reader) (io.Reader, error) {
+	switch coding {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// The deflate coding is zlib data, but some servers send raw
+		// deflate data instead.
+		br := bufio.NewReader(r)
+		if b, err := br.Peek(2); err == nil && b[0]&0x0f == 8 && (int(b[0])<<8|int(b[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	case "br":
+		return brotli.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("unsupported content coding %q", coding)
+}
+
+// encoder compresses a body, and can flush what it has compressed so far.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newEncoder returns a writer encoding into w with coding.
+func newEncoder(coding string, w io.Writer) (encoder, error) {
+	switch coding {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "deflate":
+		return zlib.NewWriter(w), nil
+	case "br":
+		return brotli.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("unsupported content coding %q", coding)
+}
+
+// decodeBody decodes a complete body encoded with coding. It fails if the
+// decoded body would exceed limit bytes.
+func decodeBody(coding string, body []byte, limit int64) ([]byte, error) {
+	r, err := newDecoder(coding, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("decoded body exceeds %d bytes", limit)
+	}
+	return b, nil
+}
+
+// decodeProbeSize is how much of an encoded body is held, at most, to check
+// that it can be decoded before its message is committed to decoding.
+const decodeProbeSize = 64 << 10
+
+// probeDecoder checks that the start of a body, encoded with coding, can be
+// decoded. ok is set once the decoder has produced output or reached the end
+// of the body, or if it has accepted decodeProbeSize bytes without error;
+// more is set if it needs more of the body to tell. complete tells whether
+// data is the whole body.
+func probeDecoder(coding string, data []byte, complete bool) (ok, more bool) {
+	if coding == "deflate" && len(data) < 2 && !complete {
+		// Not enough to tell zlib from raw deflate data.
+		return false, true
+	}
+	r, err := newDecoder(coding, bytes.NewReader(data))
+	if err == nil {
+		var b [1]byte
+		_, err = io.ReadFull(r, b[:])
+	}
+	switch {
+	case err == nil, err == io.EOF:
+		return true, false
+	case err == io.ErrUnexpectedEOF && !complete:
+		if len(data) >= decodeProbeSize {
+			return true, false
+		}
+		return false, true
+	}
+	return false, false
+}
+
+// encodeBody encodes a complete body with coding.
+func encodeBody(coding string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := newEncoder(coding, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodingReader decodes the body a transformer reads. The decoder is
+// created on the first Read, since it starts by reading the header of the
+// encoded data, which has yet to arrive when the transformer is set up.
+// Reading fails once more than limit bytes have been decoded.
+type decodingReader struct {
+	coding string
+	src    io.Reader
+	r      io.Reader
+	limit  int64
+	n      int64
+}
+
+func (d *decodingReader) Read(b []byte) (int, error) {
+	if d.r == nil {
+		r, err := newDecoder(d.coding, d.src)
+		if err != nil {
+			return 0, err
+		}
+		d.r = r
+	}
+	n, err := d.r.Read(b)
+	d.n += int64(n)
+	if d.n > d.limit {
+		return 0, fmt.Errorf("decoded body exceeds %d bytes", d.limit)
+	}
+	return n, err
+}
+
+// decodedReader marks a body that was decoded before it was fed to its
+// transformer.
+type decodedReader struct {
+	io.Reader
+}
+
+// BodyDecoded reports whether body, as passed to a RequestBodyCallback or
+// ResponseBodyCallback, was decoded from the content coding of its message
+// for the callback, as DecodeContentEncoding asks. Callbacks that parse the
+// body can use it to leave bodies that are still encoded alone.
+func BodyDecoded(body io.Reader) bool {
+	switch body.(type) {
+	case *decodingReader, decodedReader:
+		return true
+	}
+	return false
+}
+
+// encodingReader encodes the output of a transformer. What the transformer
+// produces is flushed through the encoder as it comes, so that the body
+// keeps streaming.
+type encodingReader struct {
+	src  io.Reader
+	enc  encoder
+	out  bytes.Buffer
+	buf  []byte
+	done bool
+	err  error // Returned once out is drained
+}
+
+func newEncodingReader(coding string, src io.Reader) (*encodingReader, error) {
+	r := &encodingReader{src: src, buf: make([]byte, 32*1024)}
+	enc, err := newEncoder(coding, &r.out)
+	if err != nil {
+		return nil, err
+	}
+	r.enc = enc
+	return r, nil
+}
+
+func (r *encodingReader) Read(b []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := r.src.Read(r.buf)
+		if n > 0 {
+			if _, werr := r.enc.Write(r.buf[:n]); werr != nil {
+				r.err = werr
+				continue
+			}
+			if ferr := r.enc.Flush(); ferr != nil {
+				r.err = ferr
+				continue
+			}
+		}
+		switch {
+		case err == io.EOF:
+			r.err = r.enc.Close()
+			r.done = true
+		case err != nil:
+			r.err = err
+		}
+	}
+	return r.out.Read(b)
+}
+
+// decodeContent decodes a complete body, encoded as h says, if the inspector
+// is configured to and can, and reports whether it did. With
+// DropContentEncoding the decoded body is sent without coding, and
+// Content-Encoding is removed from h. Bodies that fail to decode, or would
+// exceed MaxDecodedBodySize, are left alone.
+func (s *messageStream) decodeContent(h http.Header, body []byte) ([]byte, bool) {
+	if !s.conn.config.DecodeContentEncoding {
+		return body, false
+	}
+	coding, ok := contentCoding(h)
+	if !ok {
+		return body, false
+	}
+	decoded, err := decodeBody(coding, body, s.conn.config.maxDecodedBodySize())
+	if err != nil {
+		return body, false
+	}
+	if s.conn.config.DropContentEncoding {
+		h.Del("Content-Encoding")
+	}
+	return decoded, true
+}
+
+// encodeContent encodes a body decodeContent decoded as its header says once
+// the callbacks are done with it.
+func encodeContent(h http.Header, body []byte) ([]byte, error) {
+	if len(contentCodings(h)) == 0 {
+		return body, nil
+	}
+	coding, ok := contentCoding(h)
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported Content-Encoding %q", ErrInvalidModification, h.Get("Content-Encoding"))
+	}
+	b, err := encodeBody(coding, body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidModification, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,238 @@
+package httpinspector
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// rawDeflate compresses b as raw deflate data, as some servers send for the
+// deflate coding.
+func rawDeflate(b []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+// inspectResponse writes a response with the given header fields and body
+// through an accepted connection inspected with config, and returns the
+// response sent on with its body, decoded if it can be.
+func inspectResponse(t *testing.T, config Config, fields string, body []byte) (*http.Response, []byte) {
+	t.Helper()
+	mc := &mockConn{readData: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")}
+	conn := newInspectedConn(mc, config, false)
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	head := fmt.Sprintf("HTTP/1.1 200 OK\r\n%sContent-Length: %d\r\n\r\n", fields, len(body))
+	if _, err := conn.Write(append([]byte(head), body...)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(mc.written.Bytes())), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ContentLength >= 0 && int(resp.ContentLength) != len(sent) {
+		t.Errorf("Content-Length %d for %d bytes", resp.ContentLength, len(sent))
+	}
+	if coding, ok := contentCoding(resp.Header); ok {
+		if decoded, err := decodeBody(coding, sent, DefaultMaxDecodedBodySize); err == nil {
+			sent = decoded
+		}
+	}
+	return resp, sent
+}
+
+func TestContentEncoding(t *testing.T) {
+	const page = "<html><body>hello, world</body></html>"
+	encode := func(coding string) []byte {
+		b, err := encodeBody(coding, []byte(page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	buffered := Config{
+		BufferResponseBody:    true,
+		DecodeContentEncoding: true,
+		OnResponse: func(resp *http.Response) error {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body = io.NopCloser(bytes.NewReader(bytes.ReplaceAll(body, []byte("world"), []byte("gopher"))))
+			return nil
+		},
+	}
+	streamed := Config{
+		DecodeContentEncoding: true,
+		OnResponseBody: func(resp *http.Response, body io.Reader) io.Reader {
+			return upperReader{body}
+		},
+	}
+
+	tests := []struct {
+		name     string
+		config   Config
+		coding   string
+		body     []byte
+		want     string
+		wantSent string // Content-Encoding of the response sent on
+	}{
+		{"Gzip", buffered, "gzip", encode("gzip"), "<html><body>hello, gopher</body></html>", "gzip"},
+		{"Deflate", buffered, "deflate", encode("deflate"), "<html><body>hello, gopher</body></html>", "deflate"},
+		{"RawDeflate", buffered, "deflate", rawDeflate([]byte(page)), "<html><body>hello, gopher</body></html>", "deflate"},
+		{"Brotli", buffered, "br", encode("br"), "<html><body>hello, gopher</body></html>", "br"},
+		{"Identity", buffered, "identity", []byte(page), "<html><body>hello, gopher</body></html>", "identity"},
+		{"Unsupported", buffered, "compress", []byte("opaque"), "opaque", "compress"},
+		{"Corrupt", buffered, "gzip", []byte("not gzip at all"), "not gzip at all", "gzip"},
+		{"StreamedGzip", streamed, "gzip", encode("gzip"), strings.ToUpper(page), "gzip"},
+		{"StreamedBrotli", streamed, "br", encode("br"), strings.ToUpper(page), "br"},
+		{"StreamedCorrupt", streamed, "gzip", []byte("not gzip at all"), "not gzip at all", "gzip"},
+		{"StreamedTruncated", streamed, "gzip", encode("gzip")[:5], string(encode("gzip")[:5]), "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := inspectResponse(t, tt.config, "Content-Encoding: "+tt.coding+"\r\n", tt.body)
+			if string(body) != tt.want {
+				t.Errorf("got body %q", body)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != tt.wantSent {
+				t.Errorf("Content-Encoding %q", got)
+			}
+		})
+	}
+
+	t.Run("Drop", func(t *testing.T) {
+		for _, config := range []Config{buffered, streamed} {
+			config.DropContentEncoding = true
+			var seen string
+			if config.OnResponse != nil {
+				onResponse := config.OnResponse
+				config.OnResponse = func(resp *http.Response) error {
+					seen = resp.Header.Get("Content-Encoding")
+					return onResponse(resp)
+				}
+			}
+			resp, body := inspectResponse(t, config, "Content-Encoding: gzip\r\nVary: Accept-Encoding\r\n", encode("gzip"))
+			if got := resp.Header.Get("Content-Encoding"); got != "" || seen != "" {
+				t.Errorf("Content-Encoding %q sent, %q seen", got, seen)
+			}
+			if !strings.Contains(strings.ToLower(string(body)), "hello") {
+				t.Errorf("got body %q", body)
+			}
+		}
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		bomb := bytes.Repeat([]byte("hello, world "), 1000)
+		encoded, _ := encodeBody("gzip", bomb)
+
+		config := buffered
+		config.MaxDecodedBodySize = int64(len(bomb)) - 1
+		var seen []byte
+		config.OnResponse = func(resp *http.Response) error {
+			seen, _ = io.ReadAll(resp.Body)
+			resp.Body = io.NopCloser(bytes.NewReader(seen))
+			return nil
+		}
+		_, body := inspectResponse(t, config, "Content-Encoding: gzip\r\n", encoded)
+		if !bytes.Equal(seen, encoded) || !bytes.Equal(body, bomb) {
+			t.Errorf("callback saw %d bytes, %d sent", len(seen), len(body))
+		}
+
+		config = streamed
+		config.MaxDecodedBodySize = int64(len(bomb)) - 1
+		mc := &mockConn{readData: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")}
+		conn := newInspectedConn(mc, config, false)
+		io.ReadAll(conn)
+		head := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\n\r\n", len(encoded))
+		if _, err := conn.Write(append([]byte(head), encoded...)); !errors.Is(err, ErrInvalidModification) {
+			t.Errorf("streamed body decoded past the limit: %v", err)
+		}
+	})
+
+	t.Run("StreamedPieces", func(t *testing.T) {
+		// The decoder is probed as the body trickles in.
+		encoded := encode("deflate")
+		mc := &mockConn{readData: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")}
+		conn := newInspectedConn(mc, streamed, false)
+		io.ReadAll(conn)
+		in := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: deflate\r\nContent-Length: %d\r\n\r\n", len(encoded)) + string(encoded)
+		for i := 0; i < len(in); i++ {
+			if _, err := conn.Write([]byte{in[i]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(&mc.written), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent, _ := io.ReadAll(resp.Body)
+		if body, err := decodeBody("deflate", sent, DefaultMaxDecodedBodySize); err != nil || string(body) != strings.ToUpper(page) {
+			t.Errorf("got %q, %v", body, err)
+		}
+	})
+
+	t.Run("BodyDecoded", func(t *testing.T) {
+		for _, tt := range []struct {
+			config Config
+			coding string
+			body   []byte
+			want   bool
+		}{
+			{streamed, "gzip", encode("gzip"), true},
+			{streamed, "gzip", []byte("not gzip at all"), false},
+			{streamed, "gzip, br", encode("gzip"), false},
+			{Config{}, "gzip", encode("gzip"), false},
+			{Config{BufferResponseBody: true, DecodeContentEncoding: true}, "br", encode("br"), true},
+		} {
+			var decoded bool
+			tt.config.OnResponseBody = func(resp *http.Response, body io.Reader) io.Reader {
+				decoded = BodyDecoded(body)
+				return nil
+			}
+			inspectResponse(t, tt.config, "Content-Encoding: "+tt.coding+"\r\n", tt.body)
+			if decoded != tt.want {
+				t.Errorf("%s: BodyDecoded %v", tt.coding, decoded)
+			}
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		config := buffered
+		config.DecodeContentEncoding = false
+		encoded := encode("gzip")
+		var seen []byte
+		config.OnResponse = func(resp *http.Response) error {
+			seen, _ = io.ReadAll(resp.Body)
+			resp.Body = io.NopCloser(bytes.NewReader(seen))
+			return nil
+		}
+		inspectResponse(t, config, "Content-Encoding: gzip\r\n", encoded)
+		if !bytes.Equal(seen, encoded) {
+			t.Errorf("callback saw %q", seen)
+		}
+	})
+}
+
+func TestEncodingReaderError(t *testing.T) {
+	errBody := errors.New("body failed")
+	r, err := newEncodingReader("gzip", io.MultiReader(strings.NewReader("start"), iotest.ErrReader(errBody)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != errBody {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package httpinspector
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Exchange describes a request and its response as seen on an inspected
+// connection. The inspector attaches one to the context of every request,
+// where callbacks find it with RequestExchange and ResponseExchange, so that
+// the existing callback types can correlate responses with requests and
+// apply per-connection policy.
+type Exchange struct {
+	ConnID     uint64   // Identifies the connection within the process, from 1
+	Client     bool     // The connection was dialed through a Dialer
+	RemoteAddr net.Addr // Remote address of the connection
+	LocalAddr  net.Addr // Local address of the connection
+	Sequence   uint64   // Number of the request on the connection, from 1
+	StreamID   uint32   // HTTP/2 stream carrying the exchange; 0 for HTTP/1.x
+
+	// Request is the request, carrying the Exchange in its context.
+	Request *http.Request
+
+	// RequestTime is when the request header block was read. ResponseTime
+	// is when the header block of the final response was read; it is set
+	// before OnResponse runs, and zero until then.
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+type exchangeKey struct{}
+
+// connIDs numbers inspected connections.
+var connIDs atomic.Uint64
+
+// ExchangeFromContext returns the Exchange carried by ctx, or nil.
+func ExchangeFromContext(ctx context.Context) *Exchange {
+	x, _ := ctx.Value(exchangeKey{}).(*Exchange)
+	return x
+}
+
+// RequestExchange returns the Exchange of a request seen by the inspector,
+// or nil.
+func RequestExchange(req *http.Request) *Exchange {
+	if req == nil {
+		return nil
+	}
+	return ExchangeFromContext(req.Context())
+}
+
+// ResponseExchange returns the Exchange of a response, or nil if the
+// request it answers was not seen.
+func ResponseExchange(resp *http.Response) *Exchange {
+	if resp == nil {
+		return nil
+	}
+	return RequestExchange(resp.Request)
+}
+
+// newExchange starts an exchange for req, received on stream, and returns
+// req with the Exchange attached.
+func (c *inspectedConn) newExchange(req *http.Request, stream uint32) *http.Request {
+	c.mu.Lock()
+	c.sequence++
+	sequence := c.sequence
+	c.mu.Unlock()
+	x := &Exchange{
+		ConnID:      c.id,
+		Client:      c.client,
+		RemoteAddr:  c.RemoteAddr(),
+		LocalAddr:   c.LocalAddr(),
+		Sequence:    sequence,
+		StreamID:    stream,
+		RequestTime: time.Now(),
+	}
+	req = req.WithContext(context.WithValue(req.Context(), exchangeKey{}, x))
+	x.Request = req
+	return req
+}
+
+// responseStarted records that the final response to req has arrived.
+func responseStarted(req *http.Request) {
+	if x := RequestExchange(req); x != nil {
+		x.ResponseTime = time.Now()
+	}
+}
@@ -0,0 +1,69 @@
+package httpinspector
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestExchange(t *testing.T) {
+	var requests, responses []*Exchange
+	config := Config{
+		OnRequest: func(req *http.Request) error {
+			x := RequestExchange(req)
+			if x == nil || x.Request != req {
+				t.Fatalf("request %s has exchange %+v", req.URL, x)
+			}
+			if !x.ResponseTime.IsZero() {
+				t.Errorf("request %s has a response time", req.URL)
+			}
+			requests = append(requests, x)
+			return nil
+		},
+		OnResponse: func(resp *http.Response) error {
+			// The last response answers no request.
+			x := ResponseExchange(resp)
+			if x != nil && x.ResponseTime.Before(x.RequestTime) {
+				t.Fatalf("response %s has exchange %+v", resp.Status, x)
+			}
+			responses = append(responses, x)
+			return nil
+		},
+	}
+	in := "GET /one HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+		"GET /two HTTP/1.1\r\nHost: example.com\r\n\r\n"
+
+	mc := &mockConn{readData: []byte(in)}
+	conn := newInspectedConn(mc, config, false)
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	out := "HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n" +
+		"HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	if _, err := conn.Write([]byte(out)); err != nil {
+		t.Fatal(err)
+	}
+	other := newInspectedConn(&mockConn{readData: []byte(in)}, config, false)
+	if _, err := io.ReadAll(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 4 || len(responses) != 3 {
+		t.Fatalf("got %d requests and %d responses", len(requests), len(responses))
+	}
+	for i, x := range requests {
+		if x.Sequence != uint64(i%2+1) || x.StreamID != 0 || x.Client || x.RemoteAddr == nil || x.LocalAddr == nil {
+			t.Errorf("request %d: got %+v", i, x)
+		}
+	}
+	if requests[0].ConnID != requests[1].ConnID || requests[1].ConnID == requests[2].ConnID {
+		t.Errorf("connection IDs %d, %d, %d", requests[0].ConnID, requests[1].ConnID, requests[2].ConnID)
+	}
+	for i, want := range []*Exchange{requests[0], requests[1], nil} {
+		if responses[i] != want {
+			t.Errorf("response %d matched request %+v", i, responses[i])
+		}
+	}
+}
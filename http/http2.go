@@ -0,0 +1,699 @@
+package httpinspector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// http2Preface is the connection preface an HTTP/2 client starts with (RFC
+// 9113, section 3.4), whether it knew beforehand that the server speaks
+// HTTP/2 or negotiated it with TLS ALPN.
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// HTTP/2 frame types, flags and settings used by the inspector.
+const (
+	h2FrameData         = 0x0
+	h2FrameHeaders      = 0x1
+	h2FrameRSTStream    = 0x3
+	h2FrameSettings     = 0x4
+	h2FramePushPromise  = 0x5
+	h2FrameWindowUpdate = 0x8
+	h2FrameContinuation = 0x9
+
+	h2FlagEndStream  = 0x1
+	h2FlagAck        = 0x1
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+
+	h2SettingHeaderTableSize = 0x1
+	h2SettingMaxFrameSize    = 0x5
+
+	h2FrameHeaderLen       = 9
+	h2DefaultTableSize     = 4096
+	h2DefaultMaxFrameSize  = 16384
+	h2MaxHeaderBlockLength = http.DefaultMaxHeaderBytes
+)
+
+// http2Forbidden are the connection-specific header fields HTTP/2 messages
+// may not carry (RFC 9113, section 8.2.2). The request host travels in the
+// :authority pseudo-header instead.
+var http2Forbidden = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Host":              true,
+}
+
+// http2Conn is the state the two directions of an HTTP/2 connection share.
+// It is guarded by the mutex of the inspectedConn.
+type http2Conn struct {
+	requests map[uint32]*http.Request // Requests awaiting their response, by stream
+	owed     []http2Answer            // Answers to rejected requests, yet to be sent
+	credit   uint32                   // Flow-control window to give back for dropped DATA
+	debt     uint32                   // Flow-control window taken by the answers sent
+}
+
+// http2Answer is the response the inspector owes to a rejected request.
+type http2Answer struct {
+	stream uint32
+	resp   *http.Response
+	body   []byte
+}
+
+// http2Limits are settings a peer announced that constrain the frames sent
+// to it, not yet applied by the stream sending them.
+type http2Limits struct {
+	tableSize    uint32
+	maxFrameSize uint32
+	tableSet     bool
+	frameSet     bool
+}
+
+// http2Stream parses the HTTP/2 frames flowing in one direction of a
+// connection. Header blocks are decoded, passed to the callbacks and encoded
+// again, so the HPACK state of the receiver always follows what the
+// inspector sent it; other frames are passed on as they are.
+type http2Stream struct {
+	conn     *inspectedConn
+	peer     *http2Stream // The stream flowing the other way
+	requests bool
+	preface  bool // The client preface has yet to be passed on
+	buf      []byte
+
+	dec          *hpack.Decoder
+	enc          *hpack.Encoder
+	encBuf       bytes.Buffer
+	maxFrameSize uint32
+
+	// The header block being received, which CONTINUATION frames extend
+	block       []byte
+	blockType   byte
+	blockFlags  byte
+	blockStream uint32
+	blockPrefix []byte // The priority or promised stream fields of the frame
+
+	rejected map[uint32]bool // Streams of rejected requests, whose frames are dropped
+	limits   http2Limits     // Guarded by the mutex of the inspectedConn
+}
+
+func newHTTP2Stream(c *inspectedConn, requests bool) *http2Stream {
+	s := &http2Stream{
+		conn:         c,
+		requests:     requests,
+		preface:      requests,
+		dec:          hpack.NewDecoder(h2DefaultTableSize, nil),
+		maxFrameSize: h2DefaultMaxFrameSize,
+		rejected:     make(map[uint32]bool),
+	}
+	s.enc = hpack.NewEncoder(&s.encBuf)
+	return s
+}
+
+// startHTTP2 switches the stream to HTTP/2, after it found the preface of
+// the client or the server. The connection switches with the first stream
+// to find it.
+func (s *messageStream) startHTTP2() {
+	c := s.conn
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.h2 == nil {
+		requests := newHTTP2Stream(c, true)
+		responses := newHTTP2Stream(c, false)
+		requests.peer, responses.peer = responses, requests
+		c.h2 = &http2Conn{requests: make(map[uint32]*http.Request)}
+		c.h2Streams = [2]*http2Stream{requests, responses}
+	}
+	s.h2 = c.h2Streams[1]
+	if s.requests {
+		s.h2 = c.h2Streams[0]
+	}
+	s.state = stateHTTP2
+}
+
+// followHTTP2 switches the stream carrying responses to HTTP/2 once the
+// other one has, and reports whether it did.
+func (s *messageStream) followHTTP2() bool {
+	s.conn.mu.Lock()
+	started := s.conn.h2 != nil
+	s.conn.mu.Unlock()
+	if started {
+		s.startHTTP2()
+	}
+	return started
+}
+
+// feed processes the next bytes of the stream and returns the frames to
+// pass on. Incomplete frames are held until the rest of them is fed.
+func (s *http2Stream) feed(in []byte) ([]byte, error) {
+	s.buf = append(s.buf, in...)
+	s.applyLimits()
+	var out []byte
+	if !s.requests {
+		out = s.appendOwed(out)
+	}
+	if s.preface {
+		if len(s.buf) < len(http2Preface) {
+			return out, nil
+		}
+		out = append(out, s.buf[:len(http2Preface)]...)
+		s.buf = s.buf[:copy(s.buf, s.buf[len(http2Preface):])]
+		s.preface = false
+	}
+	for len(s.buf) >= h2FrameHeaderLen {
+		length := int(s.buf[0])<<16 | int(s.buf[1])<<8 | int(s.buf[2])
+		if len(s.buf) < h2FrameHeaderLen+length {
+			break
+		}
+		frame := s.buf[:h2FrameHeaderLen+length]
+		var err error
+		out, err = s.frame(out, frame)
+		s.buf = s.buf[:copy(s.buf, s.buf[len(frame):])]
+		if err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+// frame handles a complete frame and appends what to pass on to out.
+func (s *http2Stream) frame(out, frame []byte) ([]byte, error) {
+	typ, flags := frame[3], frame[4]
+	stream := binary.BigEndian.Uint32(frame[5:]) & (1<<31 - 1)
+	payload := frame[h2FrameHeaderLen:]
+	if s.block != nil && typ != h2FrameContinuation {
+		return out, fmt.Errorf("%w: header block interrupted", ErrMalformedHTTP)
+	}
+
+	switch typ {
+	case h2FrameHeaders, h2FramePushPromise:
+		fragment, prefix, err := headerFragment(typ, flags, payload)
+		if err != nil {
+			return out, err
+		}
+		s.blockType, s.blockFlags, s.blockStream = typ, flags, stream
+		s.blockPrefix = bytes.Clone(prefix)
+		s.block = append(make([]byte, 0, len(fragment)), fragment...)
+		if flags&h2FlagEndHeaders != 0 {
+			return s.endBlock(out)
+		}
+		return out, nil
+
+	case h2FrameContinuation:
+		if s.block == nil || stream != s.blockStream {
+			return out, fmt.Errorf("%w: unexpected CONTINUATION frame", ErrMalformedHTTP)
+		}
+		s.block = append(s.block, payload...)
+		if len(s.block) > h2MaxHeaderBlockLength {
+			return out, fmt.Errorf("%w: header block too large", ErrMalformedHTTP)
+		}
+		if flags&h2FlagEndHeaders != 0 {
+			return s.endBlock(out)
+		}
+		return out, nil
+
+	case h2FrameSettings:
+		if flags&h2FlagAck == 0 {
+			if err := s.peer.setLimits(payload); err != nil {
+				return out, err
+			}
+		}
+
+	case h2FrameData:
+		if s.rejected[stream] {
+			s.conn.creditHTTP2(uint32(len(payload)))
+			return out, nil
+		}
+
+	case h2FrameRSTStream:
+		s.conn.http2Request(stream, true)
+		if s.rejected[stream] {
+			delete(s.rejected, stream)
+			return out, nil
+		}
+
+	case h2FrameWindowUpdate:
+		if stream == 0 && len(payload) == 4 {
+			return s.appendWindowUpdate(out, frame), nil
+		}
+	}
+	if s.rejected[stream] {
+		return out, nil
+	}
+	return append(out, frame...), nil
+}
+
+// headerFragment returns the header block fragment of a HEADERS or
+// PUSH_PROMISE frame payload, and the fields preceding it.
+func headerFragment(typ, flags byte, payload []byte) (fragment, prefix []byte, err error) {
+	pad := 0
+	if flags&h2FlagPadded != 0 {
+		if len(payload) == 0 {
+			return nil, nil, fmt.Errorf("%w: invalid padding", ErrMalformedHTTP)
+		}
+		pad = int(payload[0])
+		payload = payload[1:]
+	}
+	n := 0
+	switch {
+	case typ == h2FramePushPromise:
+		n = 4
+	case flags&h2FlagPriority != 0:
+		n = 5
+	}
+	if len(payload) < n+pad {
+		return nil, nil, fmt.Errorf("%w: invalid padding", ErrMalformedHTTP)
+	}
+	return payload[n : len(payload)-pad], payload[:n], nil
+}
+
+// endBlock handles a complete header block: requests and responses go
+// through their callbacks, and every block is encoded again.
+func (s *http2Stream) endBlock(out []byte) ([]byte, error) {
+	block, typ, flags, stream, prefix := s.block, s.blockType, s.blockFlags, s.blockStream, s.blockPrefix
+	s.block, s.blockPrefix = nil, nil
+	fields, err := s.dec.DecodeFull(block)
+	if err != nil {
+		return out, fmt.Errorf("%w: %v", ErrMalformedHTTP, err)
+	}
+	if s.rejected[stream] {
+		// Trailers of a rejected request.
+		return out, nil
+	}
+
+	switch {
+	case typ == h2FramePushPromise:
+		// The promised request is not inspected, but is kept so that the
+		// pushed response can be matched with it.
+		if req, _, err := requestFromFields(fields); err == nil {
+			promised := binary.BigEndian.Uint32(prefix) & (1<<31 - 1)
+			s.conn.setHTTP2Request(promised, s.conn.newExchange(req, promised))
+		}
+	case s.requests && hasField(fields, ":method"):
+		var rejected bool
+		fields, rejected, err = s.request(stream, fields, flags&h2FlagEndStream != 0)
+		if rejected || err != nil {
+			return out, err
+		}
+	case !s.requests && hasField(fields, ":status"):
+		if fields, err = s.response(stream, fields); err != nil {
+			return out, err
+		}
+	}
+	return s.appendHeaderBlock(out, typ, flags, stream, prefix, fields), nil
+}
+
+// request runs OnRequest on the request opening stream, and returns the
+// fields to send in its place. A request the callback rejects is answered
+// by the inspector, and its stream is dropped.
+func (s *http2Stream) request(stream uint32, fields []hpack.HeaderField, endStream bool) (_ []hpack.HeaderField, rejected bool, err error) {
+	req, pseudo, err := requestFromFields(fields)
+	if err != nil {
+		return nil, false, err
+	}
+	if endStream {
+		req.ContentLength = 0
+	}
+	req = s.conn.newExchange(req, stream)
+	origURL := req.URL.String()
+	if s.conn.config.OnRequest != nil {
+		err := s.conn.config.OnRequest(req)
+		var reject *Reject
+		if errors.As(err, &reject) {
+			if err := reject.check(); err != nil {
+				return nil, false, fmt.Errorf("request modification failed: %w", err)
+			}
+			s.rejectStream(stream, req, reject)
+			return nil, true, nil
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("request modification failed: %w", err)
+		}
+	}
+	s.conn.setHTTP2Request(stream, req)
+	return requestFields(req, pseudo, fields, origURL), false, nil
+}
+
+// response runs OnResponse on a final response, and returns the fields to
+// send in its place. Interim responses are passed on as they are.
+func (s *http2Stream) response(stream uint32, fields []hpack.HeaderField) ([]hpack.HeaderField, error) {
+	status, _ := strconv.Atoi(fieldValue(fields, ":status"))
+	if status < 100 || status > 999 {
+		return nil, fmt.Errorf("%w: invalid status %q", ErrMalformedHTTP, fieldValue(fields, ":status"))
+	}
+	if status < 200 {
+		return fields, nil
+	}
+	req := s.conn.http2Request(stream, true)
+	responseStarted(req)
+	if s.conn.config.OnResponse == nil {
+		return fields, nil
+	}
+	resp := &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        headerFromFields(fields),
+		Body:          http.NoBody,
+		ContentLength: -1,
+		Request:       req,
+	}
+	if n, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = n
+	}
+	if err := s.conn.config.OnResponse(resp); err != nil {
+		return nil, fmt.Errorf("response modification failed: %w", err)
+	}
+	out := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(resp.StatusCode)}}
+	return appendHeaderFields(out, resp.Header, fields), nil
+}
+
+// rejectStream drops the stream of a rejected request and arranges for the
+// inspector to answer it.
+func (s *http2Stream) rejectStream(stream uint32, req *http.Request, reject *Reject) {
+	s.rejected[stream] = true
+	resp, body := reject.build()
+	if !reject.bodyless() {
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if req.Method == http.MethodHead {
+		body = nil
+	}
+	c := s.conn
+	c.mu.Lock()
+	c.h2.owed = append(c.h2.owed, http2Answer{stream: stream, resp: resp, body: body})
+	c.h2.debt += uint32(len(body))
+	c.mu.Unlock()
+	c.flushHTTP2()
+}
+
+// appendOwed appends the answers to rejected requests, and gives back the
+// flow-control window their dropped bodies used.
+func (s *http2Stream) appendOwed(out []byte) []byte {
+	c := s.conn
+	c.mu.Lock()
+	owed, credit := c.h2.owed, c.h2.credit
+	c.h2.owed, c.h2.credit = nil, 0
+	c.mu.Unlock()
+
+	for _, a := range owed {
+		fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(a.resp.StatusCode)}}
+		fields = appendHeaderFields(fields, a.resp.Header, nil)
+		var flags byte = h2FlagEndHeaders
+		if len(a.body) == 0 {
+			flags |= h2FlagEndStream
+		}
+		out = s.appendHeaderBlock(out, h2FrameHeaders, flags, a.stream, nil, fields)
+		for body := a.body; len(body) > 0; {
+			n := min(len(body), int(s.maxFrameSize))
+			flags = 0
+			if n == len(body) {
+				flags = h2FlagEndStream
+			}
+			out = appendHTTP2FrameHeader(out, n, h2FrameData, flags, a.stream)
+			out = append(out, body[:n]...)
+			body = body[n:]
+		}
+	}
+	if credit > 0 {
+		out = appendHTTP2FrameHeader(out, 4, h2FrameWindowUpdate, 0, 0)
+		out = binary.BigEndian.AppendUint32(out, credit)
+	}
+	return out
+}
+
+// appendWindowUpdate appends a connection-level WINDOW_UPDATE frame, less
+// the window the inspector's answers took up, which the receiver never
+// granted the peer.
+func (s *http2Stream) appendWindowUpdate(out, frame []byte) []byte {
+	increment := binary.BigEndian.Uint32(frame[h2FrameHeaderLen:]) & (1<<31 - 1)
+	c := s.conn
+	c.mu.Lock()
+	paid := min(c.h2.debt, increment)
+	c.h2.debt -= paid
+	c.mu.Unlock()
+	if paid == 0 {
+		return append(out, frame...)
+	}
+	if increment == paid {
+		return out
+	}
+	out = appendHTTP2FrameHeader(out, 4, h2FrameWindowUpdate, 0, 0)
+	return binary.BigEndian.AppendUint32(out, increment-paid)
+}
+
+// appendHeaderBlock encodes fields and appends them as a header block,
+// split into CONTINUATION frames as the receiver's frame size requires.
+// Padding is dropped.
+func (s *http2Stream) appendHeaderBlock(out []byte, typ, flags byte, stream uint32, prefix []byte, fields []hpack.HeaderField) []byte {
+	s.encBuf.Reset()
+	for _, f := range fields {
+		s.enc.WriteField(f)
+	}
+	block := s.encBuf.Bytes()
+	flags &^= h2FlagPadded | h2FlagEndHeaders
+	for {
+		n := min(len(block), int(s.maxFrameSize)-len(prefix))
+		if n == len(block) {
+			flags |= h2FlagEndHeaders
+		}
+		out = appendHTTP2FrameHeader(out, len(prefix)+n, typ, flags, stream)
+		out = append(out, prefix...)
+		out = append(out, block[:n]...)
+		block = block[n:]
+		if len(block) == 0 {
+			return out
+		}
+		typ, flags, prefix = h2FrameContinuation, 0, nil
+	}
+}
+
+func appendHTTP2FrameHeader(out []byte, length int, typ, flags byte, stream uint32) []byte {
+	out = append(out, byte(length>>16), byte(length>>8), byte(length), typ, flags)
+	return binary.BigEndian.AppendUint32(out, stream)
+}
+
+// setLimits records the settings in the payload of a SETTINGS frame sent by
+// the receiver of s.
+func (s *http2Stream) setLimits(payload []byte) error {
+	if len(payload)%6 != 0 {
+		return fmt.Errorf("%w: invalid SETTINGS frame", ErrMalformedHTTP)
+	}
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	for ; len(payload) > 0; payload = payload[6:] {
+		value := binary.BigEndian.Uint32(payload[2:])
+		switch binary.BigEndian.Uint16(payload) {
+		case h2SettingHeaderTableSize:
+			s.limits.tableSize, s.limits.tableSet = value, true
+		case h2SettingMaxFrameSize:
+			s.limits.maxFrameSize, s.limits.frameSet = value, true
+		}
+	}
+	return nil
+}
+
+// applyLimits applies the settings the receiver announced since the last
+// call.
+func (s *http2Stream) applyLimits() {
+	s.conn.mu.Lock()
+	limits := s.limits
+	s.limits = http2Limits{}
+	s.conn.mu.Unlock()
+	if limits.tableSet {
+		s.enc.SetMaxDynamicTableSizeLimit(limits.tableSize)
+		s.dec.SetAllowedMaxDynamicTableSize(limits.tableSize)
+	}
+	if limits.frameSet {
+		s.maxFrameSize = limits.maxFrameSize
+	}
+}
+
+// setHTTP2Request records the request sent on stream.
+func (c *inspectedConn) setHTTP2Request(stream uint32, req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.h2.requests[stream] = req
+}
+
+// http2Request returns the request sent on stream, removing it if pop is
+// set.
+func (c *inspectedConn) http2Request(stream uint32, pop bool) *http.Request {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	req := c.h2.requests[stream]
+	if pop {
+		delete(c.h2.requests, stream)
+	}
+	return req
+}
+
+// creditHTTP2 gives back the flow-control window of a dropped DATA frame.
+func (c *inspectedConn) creditHTTP2(n uint32) {
+	if n == 0 {
+		return
+	}
+	c.mu.Lock()
+	c.h2.credit += n
+	c.mu.Unlock()
+	c.flushHTTP2()
+}
+
+// flushHTTP2 sends what the inspector owes the client, from the stream
+// carrying responses.
+func (c *inspectedConn) flushHTTP2() {
+	if c.client {
+		// Responses are read; interrupt a Read waiting for more of them.
+		c.wake()
+		return
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.writeThrough(nil)
+}
+
+// requestFromFields returns the request described by a decoded header
+// block, and its pseudo-header fields.
+func requestFromFields(fields []hpack.HeaderField) (*http.Request, []hpack.HeaderField, error) {
+	req := &http.Request{
+		Method:        fieldValue(fields, ":method"),
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        headerFromFields(fields),
+		Body:          http.NoBody,
+		ContentLength: -1,
+		Host:          fieldValue(fields, ":authority"),
+	}
+	var pseudo []hpack.HeaderField
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			pseudo = append(pseudo, f)
+		}
+	}
+	if req.Host == "" {
+		req.Host = req.Header.Get("Host")
+	}
+	req.Header.Del("Host")
+
+	path := fieldValue(fields, ":path")
+	if req.Method == http.MethodConnect && path == "" {
+		req.URL = &url.URL{Host: req.Host}
+		req.RequestURI = req.Host
+	} else {
+		u, err := url.ParseRequestURI(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: invalid :path %q", ErrMalformedHTTP, path)
+		}
+		u.Scheme, u.Host = fieldValue(fields, ":scheme"), req.Host
+		req.URL, req.RequestURI = u, path
+	}
+	if n, err := strconv.ParseInt(req.Header.Get("Content-Length"), 10, 64); err == nil {
+		req.ContentLength = n
+	}
+	return req, pseudo, nil
+}
+
+// requestFields returns the header block fields for req, which was parsed
+// from orig, with pseudo-header fields pseudo, and whose URL was origURL.
+func requestFields(req *http.Request, pseudo, orig []hpack.HeaderField, origURL string) []hpack.HeaderField {
+	var fields []hpack.HeaderField
+	authority := false
+	for _, f := range pseudo {
+		switch f.Name {
+		case ":method":
+			f.Value = req.Method
+		case ":authority":
+			f.Value, authority = req.Host, true
+		case ":scheme":
+			if req.URL.Scheme != "" {
+				f.Value = req.URL.Scheme
+			}
+		case ":path":
+			if req.URL.String() != origURL {
+				f.Value = req.URL.RequestURI()
+			}
+		}
+		fields = append(fields, f)
+	}
+	if !authority && req.Host != "" {
+		fields = append(fields, hpack.HeaderField{Name: "host", Value: req.Host})
+	}
+	return appendHeaderFields(fields, req.Header, orig)
+}
+
+// headerFromFields returns the regular fields of a decoded header block.
+func headerFromFields(fields []hpack.HeaderField) http.Header {
+	h := make(http.Header)
+	for _, f := range fields {
+		if !strings.HasPrefix(f.Name, ":") {
+			h.Add(f.Name, f.Value)
+		}
+	}
+	return h
+}
+
+// appendHeaderFields appends the fields of h to fields: those parsed from
+// orig in their original order and sensitivity, then the ones added, in
+// sorted order. Fields HTTP/2 forbids are left out.
+func appendHeaderFields(fields []hpack.HeaderField, h http.Header, orig []hpack.HeaderField) []hpack.HeaderField {
+	var names []string
+	seen := make(map[string]bool)
+	sensitive := make(map[string]bool)
+	for _, f := range orig {
+		if strings.HasPrefix(f.Name, ":") {
+			continue
+		}
+		key := http.CanonicalHeaderKey(f.Name)
+		sensitive[key] = sensitive[key] || f.Sensitive
+		if !seen[key] {
+			seen[key] = true
+			names = append(names, key)
+		}
+	}
+	var added []string
+	for key := range h {
+		if !seen[key] {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+	for _, key := range append(names, added...) {
+		if http2Forbidden[key] {
+			continue
+		}
+		for _, v := range h[key] {
+			fields = append(fields, hpack.HeaderField{Name: strings.ToLower(key), Value: v, Sensitive: sensitive[key]})
+		}
+	}
+	return fields
+}
+
+func hasField(fields []hpack.HeaderField, name string) bool {
+	for _, f := range fields {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func fieldValue(fields []hpack.HeaderField, name string) string {
+	for _, f := range fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
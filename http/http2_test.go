@@ -0,0 +1,156 @@
+package httpinspector
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// serveHTTP2 serves HTTP/2 without TLS on the connections l accepts.
+func serveHTTP2(l net.Listener, handler http.Handler) {
+	server := &http2.Server{}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go server.ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+	}
+}
+
+// http2Client returns a client speaking HTTP/2 without TLS on the
+// connections dial returns.
+func http2Client(dial func(ctx context.Context, network, address string) (net.Conn, error)) *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, address string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx, network, address)
+		},
+	}}
+}
+
+func TestInspectorHTTP2(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blocked" || r.URL.Path == "/nocontent" {
+			t.Errorf("server saw %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Server", "test")
+		if r.URL.Path == "/big" {
+			// Too large for a single frame.
+			w.Header().Set("X-Big", strings.Repeat("a", 40000))
+		}
+		fmt.Fprintf(w, "%s %s %s %d", r.Proto, r.URL.RequestURI(), r.Header.Get("X-Inspected"), len(body))
+	})
+	config := Config{
+		OnRequest: func(req *http.Request) error {
+			if req.Proto != "HTTP/2.0" || req.Host == "" || req.URL.Scheme != "http" {
+				t.Errorf("request %s %s %s", req.Proto, req.Host, req.URL)
+			}
+			switch req.URL.Path {
+			case "/blocked":
+				return &Reject{Status: http.StatusUnavailableForLegalReasons, Body: []byte("blocked\n")}
+			case "/nocontent":
+				return &Reject{Status: http.StatusNoContent}
+			}
+			req.Header.Set("X-Inspected", "h2")
+			if req.URL.Path == "/old" {
+				req.URL.Path = "/new"
+			}
+			return nil
+		},
+		OnResponse: func(resp *http.Response) error {
+			resp.Header.Del("Server")
+			resp.Header.Set("X-Request", resp.Request.URL.Path)
+			if x := ResponseExchange(resp); x == nil || x.StreamID == 0 || x.Request != resp.Request {
+				t.Errorf("response to %s has exchange %+v", resp.Request.URL, x)
+			}
+			return nil
+		},
+	}
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		want               string
+	}{
+		{"GET", "/old?q=1", "", http.StatusOK, "HTTP/2.0 /new?q=1 h2 0"},
+		{"GET", "/old?q=1", "", http.StatusOK, "HTTP/2.0 /new?q=1 h2 0"},
+		{"POST", "/upload", "data", http.StatusOK, "HTTP/2.0 /upload h2 4"},
+		{"GET", "/big", "", http.StatusOK, "HTTP/2.0 /big h2 0"},
+		{"POST", "/blocked", strings.Repeat("x", 200000), http.StatusUnavailableForLegalReasons, "blocked\n"},
+		{"POST", "/upload", strings.Repeat("y", 200000), http.StatusOK, "HTTP/2.0 /upload h2 200000"},
+		{"GET", "/blocked", "", http.StatusUnavailableForLegalReasons, "blocked\n"},
+		{"GET", "/nocontent", "", http.StatusNoContent, ""},
+		{"GET", "/after", "", http.StatusOK, "HTTP/2.0 /after h2 0"},
+	}
+	run := func(t *testing.T, client *http.Client, url string) {
+		for _, tt := range tests {
+			req, _ := http.NewRequest(tt.method, url+tt.path, strings.NewReader(tt.body))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: %v", tt.method, tt.path, err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil || resp.StatusCode != tt.status || string(body) != tt.want {
+				t.Errorf("%s %s: got %s %q, %v", tt.method, tt.path, resp.Status, body, err)
+			}
+			if resp.StatusCode == http.StatusOK {
+				if resp.Header.Get("Server") != "" || resp.Header.Get("X-Request") == "" {
+					t.Errorf("%s %s: response header %v", tt.method, tt.path, resp.Header)
+				}
+				if tt.path == "/big" && len(resp.Header.Get("X-Big")) != 40000 {
+					t.Errorf("X-Big has %d bytes", len(resp.Header.Get("X-Big")))
+				}
+			}
+		}
+	}
+
+	t.Run("Server", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go serveHTTP2(New(l, config), handler)
+		run(t, http2Client((&net.Dialer{}).DialContext), "http://"+l.Addr().String())
+	})
+
+	t.Run("Client", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go serveHTTP2(l, handler)
+		run(t, http2Client(NewDialer(nil, config).DialContext), "http://"+l.Addr().String())
+	})
+}
+
+func TestInspectorHTTP2Disabled(t *testing.T) {
+	var prefix string
+	config := Config{
+		DisableHTTP2: true,
+		OnNonHTTP: func(conn net.Conn, b []byte) NonHTTPAction {
+			prefix = string(b)
+			return NonHTTPPass
+		},
+	}
+	in := http2Preface + "\x00\x00\x00\x04\x00\x00\x00\x00\x00"
+	conn := newInspectedConn(&mockConn{readData: []byte(in), readChunk: 5}, config, false)
+	out, err := io.ReadAll(conn)
+	if err != nil || string(out) != in {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	if !strings.HasPrefix(prefix, "PRI") {
+		t.Errorf("OnNonHTTP saw %q", prefix)
+	}
+}
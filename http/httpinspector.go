@@ -3,13 +3,10 @@
 package httpinspector
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
-	"fmt"
+	"io"
 	"net"
 	"net/http"
-	"strings"
 	"sync"
 )
 
@@ -18,6 +15,8 @@ var (
 	ErrInvalidModification = errors.New("invalid HTTP message modification")
 	ErrMalformedHTTP       = errors.New("malformed HTTP message")
 	ErrClosedInspector     = errors.New("inspector is closed")
+	ErrNonHTTP             = errors.New("non-HTTP traffic dropped")
+	ErrBodyTooLarge        = errors.New("HTTP message body too large to buffer")
 )
 
 // RequestCallback is called for each HTTP request intercepted.
@@ -26,10 +25,170 @@ type RequestCallback func(*http.Request) error
 // ResponseCallback is called for each HTTP response intercepted.
 type ResponseCallback func(*http.Response) error
 
+// RequestBodyCallback is called for each request with a body, after
+// OnRequest. It returns a reader producing the body to forward in place of
+// body, or nil to forward the body unchanged.
+type RequestBodyCallback func(req *http.Request, body io.Reader) io.Reader
+
+// ResponseBodyCallback is called for each response with a body, after
+// OnResponse. It returns a reader producing the body to forward in place of
+// body, or nil to forward the body unchanged.
+type ResponseBodyCallback func(resp *http.Response, body io.Reader) io.Reader
+
+// NonHTTPAction tells the inspector what to do with traffic that is not
+// HTTP.
+type NonHTTPAction int
+
+const (
+	// NonHTTPPass forwards the traffic unchanged for the rest of the
+	// connection.
+	NonHTTPPass NonHTTPAction = iota
+	// NonHTTPDrop closes the connection. The Read or Write carrying the
+	// traffic fails with ErrNonHTTP.
+	NonHTTPDrop
+)
+
+// NonHTTPCallback is called when traffic that is not HTTP is found on a
+// connection, where a request or response should start. conn is the
+// underlying connection and prefix the bytes that were examined; prefix
+// must not be retained.
+type NonHTTPCallback func(conn net.Conn, prefix []byte) NonHTTPAction
+
+// TunnelCallback is called when a connection stops carrying HTTP after the
+// successful CONNECT or protocol upgrade answered by resp, to inspect what
+// follows; resp.Request is the request, if it was seen. conn carries the bytes as they appear on the wire; the callback
+// returns the connection to use in its place, typically one wrapping conn,
+// such as a TLS or SNI inspector. It must not read from or write to conn
+// before returning.
+type TunnelCallback func(resp *http.Response, conn net.Conn) net.Conn
+
+// UpgradeCallback is called for each request asking to upgrade the
+// connection to another protocol, named as in its Upgrade header.
+type UpgradeCallback func(req *http.Request, protocol string) error
+
 // Config contains configuration options for the HTTP inspector.
+//
+// Every message on a connection is inspected, including pipelined and
+// keep-alive requests and the responses to them. Callbacks run once the
+// header block has arrived; unless the body is buffered, req.Body and
+// resp.Body are empty and the body is forwarded unchanged after the
+// (possibly modified) header. Interim 1xx responses other than 101 are
+// forwarded without calling OnResponse. The context of each request
+// carries an *Exchange describing its connection and timing, which
+// RequestExchange and ResponseExchange return.
 type Config struct {
 	OnRequest  RequestCallback  // Called for each request
 	OnResponse ResponseCallback // Called for each response
+
+	// BufferRequestBody delays OnRequest until the whole request body has
+	// arrived and makes it available as req.Body. The callback may replace
+	// req.Body; Content-Length is set to match whatever body it leaves.
+	// The request is not forwarded until then, so a client sending
+	// "Expect: 100-continue" waits out its own timeout before sending the
+	// body.
+	BufferRequestBody bool
+
+	// BufferResponseBody does the same for OnResponse and resp.Body.
+	// Responses are then held until complete, including streamed ones
+	// such as server-sent events; without it each piece of a response body
+	// is forwarded as soon as it is written, so flushes by the server reach
+	// the client immediately.
+	BufferResponseBody bool
+
+	// MaxBufferedBodySize limits the size of the bodies buffered above.
+	// DefaultMaxBufferedBodySize is used if it is zero. A request whose body
+	// grows past it is answered with 413 Content Too Large and the
+	// connection closed; a response fails with ErrBodyTooLarge.
+	MaxBufferedBodySize int64
+
+	// OnRequestBody and OnResponseBody transform bodies as they stream
+	// through, so that large bodies can be scanned or rewritten without
+	// holding them in memory. The returned reader is read as the body
+	// arrives; whatever it has produced is forwarded each time it waits for
+	// more input. Transformed bodies are sent with chunked transfer-coding,
+	// or with a Content-Length for HTTP/1.0 peers, in which case the
+	// transformed body is held until complete. A body buffered for OnRequest
+	// or OnResponse is transformed after that callback.
+	OnRequestBody  RequestBodyCallback
+	OnResponseBody ResponseBodyCallback
+
+	// DecodeContentEncoding decodes bodies sent with a gzip, deflate or br
+	// Content-Encoding before they reach the callbacks above, so that they
+	// see plain text. Once they are done, the body is encoded again as its
+	// Content-Encoding header then says, and Content-Length is set to match.
+	// DropContentEncoding sends decoded bodies as they are instead, and
+	// removes Content-Encoding before the callbacks run. Bodies with other or
+	// several codings, and bodies whose start fails to decode, are left
+	// alone; a streamed body is held until enough of it has arrived to tell.
+	// BodyDecoded tells body transformers which bodies were decoded.
+	DecodeContentEncoding bool
+	DropContentEncoding   bool
+
+	// MaxDecodedBodySize limits the size of decoded bodies, protecting the
+	// inspector from bodies that decompress to huge sizes.
+	// DefaultMaxDecodedBodySize is used if it is zero. Buffered bodies that
+	// would decode to more are left encoded. A streamed body has been partly
+	// sent on by the time it exceeds the limit, so its message fails with
+	// ErrInvalidModification.
+	MaxDecodedBodySize int64
+
+	// ExtensionMethods lists request methods recognized in addition to
+	// those of RFC 9110 and PATCH, such as WebDAVMethods. A request line
+	// must name a recognized method and an HTTP/1.x version to be
+	// inspected.
+	ExtensionMethods []string
+
+	// OnTunnel inspects the tunnels established by CONNECT requests. Tunnels
+	// are passed through uninspected if it is nil. OnRequest sees the
+	// CONNECT request itself, and can deny it by destination (req.URL.Host)
+	// by returning a *Reject.
+	OnTunnel TunnelCallback
+
+	// OnUpgrade is called after OnRequest for requests asking to switch
+	// protocols, such as WebSocket and h2c. Like OnRequest, it can refuse
+	// the upgrade by returning a *Reject. Once a 101 response switches the
+	// connection, the inspector in UpgradeInspectors for the protocol takes
+	// it over; keys are protocol names without a version and match
+	// case-insensitively. Protocols without an inspector are passed through.
+	OnUpgrade         UpgradeCallback
+	UpgradeInspectors map[string]TunnelCallback
+
+	// DisableHTTP2 turns off HTTP/2 inspection. Connections starting with
+	// the HTTP/2 client preface are otherwise inspected frame by frame:
+	// OnRequest and OnResponse see each request and response, with the
+	// pseudo-header fields mapped to the usual Request and Response fields,
+	// and a *Reject is answered on the request's stream. Bodies are passed
+	// through; the body options only apply to HTTP/1.x. With DisableHTTP2,
+	// HTTP/2 connections are left to OnNonHTTP.
+	DisableHTTP2 bool
+
+	// OnNonHTTP decides what happens to traffic that is not HTTP. Such
+	// traffic is passed through uninspected if it is nil.
+	OnNonHTTP NonHTTPCallback
+}
+
+// DefaultMaxBufferedBodySize is the size of the largest buffered body when
+// Config.MaxBufferedBodySize is zero.
+const DefaultMaxBufferedBodySize = 16 << 20
+
+// maxBufferedBodySize returns the limit on buffered bodies.
+func (c Config) maxBufferedBodySize() int64 {
+	if c.MaxBufferedBodySize <= 0 {
+		return DefaultMaxBufferedBodySize
+	}
+	return c.MaxBufferedBodySize
+}
+
+// DefaultMaxDecodedBodySize is the size of the largest decoded body when
+// Config.MaxDecodedBodySize is zero.
+const DefaultMaxDecodedBodySize = 16 << 20
+
+// maxDecodedBodySize returns the limit on decoded bodies.
+func (c Config) maxDecodedBodySize() int64 {
+	if c.MaxDecodedBodySize <= 0 {
+		return DefaultMaxDecodedBodySize
+	}
+	return c.MaxDecodedBodySize
 }
 
 // DefaultRequestCallback is a no-op request callback.
@@ -41,8 +200,9 @@ func DefaultResponseCallback(*http.Response) error { return nil }
 // DefaultConfig returns a Config with reasonable defaults.
 func DefaultConfig() Config {
 	return Config{
-		OnRequest:  DefaultRequestCallback,
-		OnResponse: DefaultResponseCallback,
+		OnRequest:        DefaultRequestCallback,
+		OnResponse:       DefaultResponseCallback,
+		ExtensionMethods: WebDAVMethods,
 	}
 }
 
@@ -76,10 +236,7 @@ func (i *Inspector) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
-	return &inspectedConn{
-		Conn:   conn,
-		config: i.config,
-	}, nil
+	return newInspectedConn(conn, i.config, false), nil
 }
 
 // Close implements the net.Listener Close method.
@@ -99,121 +256,3 @@ func (i *Inspector) Close() error {
 func (i *Inspector) Addr() net.Addr {
 	return i.listener.Addr()
 }
-
-// inspectedConn wraps a net.Conn to provide HTTP inspection.
-type inspectedConn struct {
-	net.Conn
-	config     Config
-	reader     *bufio.Reader
-	writer     *bufio.Writer
-	readMu     sync.Mutex
-	writeMu    sync.Mutex
-	firstRead  bool
-	firstWrite bool
-}
-
-// Read implements the net.Conn Read method with HTTP inspection.
-func (c *inspectedConn) Read(b []byte) (int, error) {
-	c.readMu.Lock()
-	defer c.readMu.Unlock()
-
-	if c.reader == nil {
-		c.reader = bufio.NewReader(c.Conn)
-	}
-
-	// Only inspect the first read for HTTP requests
-	if !c.firstRead && c.config.OnRequest != nil {
-		c.firstRead = true
-		return c.handleHTTPRequest(b)
-	}
-
-	return c.reader.Read(b)
-}
-
-// Write implements the net.Conn Write method with HTTP inspection.
-func (c *inspectedConn) Write(b []byte) (int, error) {
-	c.writeMu.Lock()
-	defer c.writeMu.Unlock()
-
-	if c.writer == nil {
-		c.writer = bufio.NewWriter(c.Conn)
-	}
-
-	// Only inspect the first write for HTTP responses
-	if !c.firstWrite && c.config.OnResponse != nil {
-		c.firstWrite = true
-		return c.handleHTTPResponse(b)
-	}
-
-	return c.writer.Write(b)
-}
-
-// handleHTTPRequest processes incoming HTTP requests.
-func (c *inspectedConn) handleHTTPRequest(b []byte) (int, error) {
-	// Peek to verify HTTP request
-	peek, err := c.reader.Peek(4)
-	if err != nil {
-		return 0, err
-	}
-
-	// Check for HTTP method
-	if !isHTTPMethod(string(peek)) {
-		return c.reader.Read(b)
-	}
-
-	// Read and parse the request
-	req, err := http.ReadRequest(c.reader)
-	if err != nil {
-		return 0, fmt.Errorf("%w: %v", ErrMalformedHTTP, err)
-	}
-	defer req.Body.Close()
-
-	// Apply request callback
-	if err := c.config.OnRequest(req); err != nil {
-		return 0, fmt.Errorf("request modification failed: %w", err)
-	}
-
-	// Buffer the modified request
-	var buf bytes.Buffer
-	if err := req.Write(&buf); err != nil {
-		return 0, fmt.Errorf("%w: %v", ErrInvalidModification, err)
-	}
-
-	// Copy the modified request to the output buffer
-	return copy(b, buf.Bytes()), nil
-}
-
-// handleHTTPResponse processes outgoing HTTP responses.
-func (c *inspectedConn) handleHTTPResponse(b []byte) (int, error) {
-	// Parse the response
-	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
-	if err != nil {
-		return c.writer.Write(b)
-	}
-	defer resp.Body.Close()
-
-	// Apply response callback
-	if err := c.config.OnResponse(resp); err != nil {
-		return 0, fmt.Errorf("response modification failed: %w", err)
-	}
-
-	// Buffer the modified response
-	var buf bytes.Buffer
-	if err := resp.Write(&buf); err != nil {
-		return 0, fmt.Errorf("%w: %v", ErrInvalidModification, err)
-	}
-
-	// Write the modified response
-	return c.writer.Write(buf.Bytes())
-}
-
-// isHTTPMethod checks if the given string starts with an HTTP method.
-func isHTTPMethod(s string) bool {
-	methods := []string{"GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS", "PATCH"}
-	for _, method := range methods {
-		if strings.HasPrefix(s, method) {
-			return true
-		}
-	}
-	return false
-}
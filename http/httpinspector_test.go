@@ -1,6 +1,10 @@
 package httpinspector
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -73,8 +77,10 @@ func (m *mockListener) Addr() net.Addr {
 }
 
 type mockConn struct {
-	readData []byte
-	readPos  int
+	readData  []byte
+	readPos   int
+	readChunk int // Maximum bytes returned per Read, if non-zero
+	written   bytes.Buffer
 }
 
 func (m *mockConn) Close() error {
@@ -85,13 +91,17 @@ func (m *mockConn) Read(b []byte) (n int, err error) {
 	if m.readPos >= len(m.readData) {
 		return 0, io.EOF
 	}
-	n = copy(b, m.readData[m.readPos:])
+	data := m.readData[m.readPos:]
+	if m.readChunk > 0 && len(data) > m.readChunk {
+		data = data[:m.readChunk]
+	}
+	n = copy(b, data)
 	m.readPos += n
 	return n, nil
 }
 
 func (m *mockConn) Write(b []byte) (n int, err error) {
-	return len(b), nil
+	return m.written.Write(b)
 }
 
 func (m *mockConn) LocalAddr() net.Addr {
@@ -113,3 +123,506 @@ func (m *mockConn) SetReadDeadline(t time.Time) error {
 func (m *mockConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
+
+func TestInspectorKeepAlive(t *testing.T) {
+	config := Config{
+		OnRequest: func(req *http.Request) error {
+			req.Header.Set("X-Modified", "true")
+			return nil
+		},
+		OnResponse: func(resp *http.Response) error {
+			resp.Header.Set("X-Modified", "true")
+			return nil
+		},
+	}
+
+	requests := "GET /one HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+		"POST /two HTTP/1.1\r\nHost: example.com\r\nContent-Length: 11\r\n\r\nhello world" +
+		"PUT /three HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"
+
+	t.Run("Requests", func(t *testing.T) {
+		// Feed the requests a few bytes at a time so that every message
+		// boundary falls in the middle of a read.
+		conn := newInspectedConn(&mockConn{readData: []byte(requests), readChunk: 7}, config, false)
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqs := readRequests(t, string(data))
+		if len(reqs) != 3 {
+			t.Fatalf("got %d requests, want 3", len(reqs))
+		}
+		for i, want := range []string{"", "hello world", "hello"} {
+			if reqs[i].Header.Get("X-Modified") != "true" {
+				t.Errorf("request %d (%s) not modified", i, reqs[i].URL)
+			}
+			body, _ := io.ReadAll(reqs[i].Body)
+			if string(body) != want {
+				t.Errorf("request %d body %q, want %q", i, body, want)
+			}
+		}
+	})
+
+	t.Run("Responses", func(t *testing.T) {
+		mc := &mockConn{readData: []byte(requests)}
+		conn := newInspectedConn(mc, config, false)
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Fatal(err)
+		}
+		responses := "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\none" +
+			"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\ntwo\r\n0\r\n\r\n" +
+			"HTTP/1.1 204 No Content\r\n\r\n"
+		for i := 0; i < len(responses); i += 5 {
+			end := min(i+5, len(responses))
+			if n, err := conn.Write([]byte(responses[i:end])); err != nil || n != end-i {
+				t.Fatalf("Write returned %d, %v", n, err)
+			}
+		}
+		br := bufio.NewReader(bytes.NewReader(mc.written.Bytes()))
+		for i, want := range []string{"one", "two", ""} {
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatalf("response %d: %v", i, err)
+			}
+			if resp.Header.Get("X-Modified") != "true" {
+				t.Errorf("response %d not modified", i)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != want {
+				t.Errorf("response %d body %q, want %q", i, body, want)
+			}
+		}
+	})
+
+	t.Run("Server", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		inspector := New(l, config)
+		seen := make(chan string, 3)
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen <- r.Header.Get("X-Modified")
+			io.Copy(io.Discard, r.Body)
+			w.Write([]byte(strings.Repeat("x", 10000)))
+		})}
+		go server.Serve(inspector)
+		defer server.Close()
+
+		client := &http.Client{}
+		for i := 0; i < 3; i++ {
+			resp, err := client.Post("http://"+l.Addr().String(), "text/plain", strings.NewReader("body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if len(body) != 10000 {
+				t.Errorf("response %d: got %d body bytes", i, len(body))
+			}
+			if resp.Header.Get("X-Modified") != "true" {
+				t.Errorf("response %d not modified", i)
+			}
+			if got := <-seen; got != "true" {
+				t.Errorf("request %d not modified", i)
+			}
+		}
+	})
+}
+
+func TestInspectorBufferLimit(t *testing.T) {
+	config := Config{
+		BufferRequestBody:   true,
+		BufferResponseBody:  true,
+		MaxBufferedBodySize: 8,
+	}
+
+	t.Run("Requests", func(t *testing.T) {
+		requests := "POST /small HTTP/1.1\r\nHost: example.com\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\nhello" +
+			"POST /large HTTP/1.1\r\nHost: example.com\r\nContent-Length: 11\r\n\r\nhello world"
+		mc := &mockConn{readData: []byte(requests), readChunk: 7}
+		conn := newInspectedConn(mc, config, false)
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqs := readRequests(t, string(data))
+		if len(reqs) != 1 || reqs[0].URL.Path != "/small" || reqs[0].Header.Get("Expect") != "100-continue" {
+			t.Fatalf("got %q", data)
+		}
+		// The inspector answers the large request after the small one, and
+		// leaves the client waiting for "100 Continue" to the server.
+		if _, err := conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		br := bufio.NewReader(&mc.written)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("got %v, %v", resp, err)
+		}
+		resp, err = http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusRequestEntityTooLarge || !resp.Close {
+			t.Errorf("got %s, close %v", resp.Status, resp.Close)
+		}
+	})
+
+	t.Run("Responses", func(t *testing.T) {
+		conn := newInspectedConn(&mockConn{readData: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")}, config, false)
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Fatal(err)
+		}
+		_, err := conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\nhello world"))
+		if !errors.Is(err, ErrBodyTooLarge) {
+			t.Errorf("got %v", err)
+		}
+	})
+}
+
+// readRequests parses every request in data.
+func readRequests(t *testing.T, data string) []*http.Request {
+	t.Helper()
+	var reqs []*http.Request
+	br := bufio.NewReader(strings.NewReader(data))
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return reqs
+		}
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			t.Fatalf("request %d: %v", len(reqs), err)
+		}
+		body, _ := io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		reqs = append(reqs, req)
+	}
+}
+
+func TestInspectorFragmentedResponses(t *testing.T) {
+	t.Run("BufferedBody", func(t *testing.T) {
+		config := Config{
+			BufferResponseBody: true,
+			OnResponse: func(resp *http.Response) error {
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					return err
+				}
+				resp.Body = io.NopCloser(bytes.NewReader(bytes.ToUpper(body)))
+				return nil
+			},
+		}
+		mc := &mockConn{readData: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")}
+		conn := newInspectedConn(mc, config, false)
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Fatal(err)
+		}
+		// Headers, then the body in several chunked writes, as net/http does.
+		for _, part := range []string{
+			"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n",
+			"Transfer-Encoding: chunked\r\n\r\n",
+			"6\r\nhello \r\n",
+			"5\r\nworld\r\n",
+			"0\r\n\r\n",
+		} {
+			if _, err := conn.Write([]byte(part)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(&mc.written), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "HELLO WORLD" || resp.ContentLength != 11 {
+			t.Errorf("got body %q with Content-Length %d", body, resp.ContentLength)
+		}
+	})
+
+	t.Run("Streaming", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		inspector := New(l, Config{OnResponse: func(resp *http.Response) error {
+			resp.Header.Set("X-Modified", "true")
+			return nil
+		}})
+		proceed := make(chan struct{})
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("first\n"))
+			w.(http.Flusher).Flush()
+			<-proceed
+			w.Write([]byte("second\n"))
+		})}
+		go server.Serve(inspector)
+		defer server.Close()
+
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.Header.Get("X-Modified") != "true" {
+			t.Error("response not modified")
+		}
+		br := bufio.NewReader(resp.Body)
+		// The first line must arrive while the handler is still running.
+		line, err := br.ReadString('\n')
+		if err != nil || line != "first\n" {
+			t.Fatalf("got %q, %v", line, err)
+		}
+		close(proceed)
+		rest, _ := io.ReadAll(br)
+		if string(rest) != "second\n" {
+			t.Errorf("got %q", rest)
+		}
+	})
+}
+
+// upperReader upper-cases everything read through it.
+type upperReader struct {
+	r io.Reader
+}
+
+func (u upperReader) Read(b []byte) (int, error) {
+	n, err := u.r.Read(b)
+	copy(b, bytes.ToUpper(b[:n]))
+	return n, err
+}
+
+func TestInspectorBodyStreaming(t *testing.T) {
+	t.Run("Upload", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		inspector := New(l, Config{OnRequestBody: func(req *http.Request, body io.Reader) io.Reader {
+			return upperReader{body}
+		}})
+		gotFirst := make(chan struct{})
+		result := make(chan string, 1)
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			br := bufio.NewReader(r.Body)
+			line, _ := br.ReadString('\n')
+			close(gotFirst)
+			rest, _ := io.ReadAll(br)
+			result <- fmt.Sprintf("%v %d %s%s", r.TransferEncoding, r.ContentLength, line, rest)
+		})}
+		go server.Serve(inspector)
+		defer server.Close()
+
+		pr, pw := io.Pipe()
+		go func() {
+			pw.Write([]byte("first\n"))
+			// The first line must reach the server before the upload ends.
+			<-gotFirst
+			pw.Write([]byte("second\n"))
+			pw.Close()
+		}()
+		resp, err := http.Post("http://"+l.Addr().String(), "text/plain", pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := <-result; got != "[chunked] -1 FIRST\nSECOND\n" {
+			t.Errorf("got %q", got)
+		}
+	})
+
+	t.Run("HTTP10", func(t *testing.T) {
+		config := Config{OnResponseBody: func(resp *http.Response, body io.Reader) io.Reader {
+			return io.MultiReader(upperReader{body}, strings.NewReader(" and more"))
+		}}
+		mc := &mockConn{readData: []byte("GET / HTTP/1.0\r\n\r\n")}
+		conn := newInspectedConn(mc, config, false)
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Fatal(err)
+		}
+		for _, part := range []string{"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhel", "lo"} {
+			if _, err := conn.Write([]byte(part)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(&mc.written), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "HELLO and more" || resp.ContentLength != 14 {
+			t.Errorf("got body %q with Content-Length %d", body, resp.ContentLength)
+		}
+	})
+
+	t.Run("Unchanged", func(t *testing.T) {
+		config := Config{OnRequestBody: func(req *http.Request, body io.Reader) io.Reader {
+			return nil
+		}}
+		in := "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello"
+		conn := newInspectedConn(&mockConn{readData: []byte(in)}, config, false)
+		out, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != in {
+			t.Errorf("got %q", out)
+		}
+	})
+}
+
+func TestInspectorReject(t *testing.T) {
+	reject := func(req *http.Request) error {
+		switch req.URL.Path {
+		case "/blocked":
+			return &Reject{Status: http.StatusUnavailableForLegalReasons, Body: []byte("blocked\n")}
+		case "/closed":
+			return &Reject{Status: http.StatusTooManyRequests, Close: true}
+		case "/nocontent":
+			return &Reject{Status: http.StatusNoContent, Body: []byte("ignored"), Headers: http.Header{"Content-Length": {"7"}}}
+		case "/notmodified":
+			return &Reject{Status: http.StatusNotModified}
+		case "/interim":
+			return &Reject{Status: http.StatusSwitchingProtocols}
+		}
+		return nil
+	}
+
+	t.Run("Server", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var seen []string
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = append(seen, r.URL.Path)
+		})}
+		go server.Serve(New(l, Config{OnRequest: reject}))
+		defer server.Close()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		for _, path := range []string{"/blocked", "/ok"} {
+			fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\nbody", path)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if path == "/blocked" && (resp.StatusCode != 451 || string(body) != "blocked\n") {
+				t.Errorf("got %s %q", resp.Status, body)
+			}
+			if path == "/ok" && resp.StatusCode != 200 {
+				t.Errorf("got %s", resp.Status)
+			}
+		}
+		if len(seen) != 1 || seen[0] != "/ok" {
+			t.Errorf("server saw %v", seen)
+		}
+	})
+
+	t.Run("Pipelined", func(t *testing.T) {
+		mc := &mockConn{readData: []byte(
+			"GET /first HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+				"GET /blocked HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+				"GET /third HTTP/1.1\r\nHost: example.com\r\n\r\n")}
+		conn := newInspectedConn(mc, Config{OnRequest: reject}, false)
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqs := readRequests(t, string(data))
+		if len(reqs) != 2 || reqs[0].URL.Path != "/first" || reqs[1].URL.Path != "/third" {
+			t.Fatalf("server saw %d requests", len(reqs))
+		}
+		if mc.written.Len() != 0 {
+			t.Fatalf("rejection sent before the response it follows: %q", mc.written.String())
+		}
+		// The rejection goes out between the responses the server writes.
+		for _, body := range []string{"first", "third"} {
+			fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		}
+		br := bufio.NewReader(&mc.written)
+		for _, want := range []int{200, 451, 200} {
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.ReadAll(resp.Body)
+			if resp.StatusCode != want {
+				t.Errorf("got status %d, want %d", resp.StatusCode, want)
+			}
+		}
+	})
+
+	t.Run("Bodyless", func(t *testing.T) {
+		// Nothing may follow the header of a 204 or 304 on a connection
+		// that is kept alive.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.URL.Path)
+		})}
+		go server.Serve(New(l, Config{OnRequest: reject}))
+		defer server.Close()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		for _, tt := range []struct {
+			path string
+			want int
+		}{{"/nocontent", 204}, {"/ok", 200}, {"/notmodified", 304}, {"/after", 200}} {
+			fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: example.com\r\n\r\n", tt.path)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.path, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.want || tt.want == 200 && string(body) != tt.path {
+				t.Errorf("%s: got %s %q", tt.path, resp.Status, body)
+			}
+			if tt.want != 200 && (resp.Header.Get("Content-Length") != "" || resp.Header.Get("Content-Type") != "") {
+				t.Errorf("%s: got header %v", tt.path, resp.Header)
+			}
+		}
+	})
+
+	t.Run("Interim", func(t *testing.T) {
+		mc := &mockConn{readData: []byte("GET /interim HTTP/1.1\r\nHost: example.com\r\n\r\n")}
+		conn := newInspectedConn(mc, Config{OnRequest: reject}, false)
+		if _, err := io.ReadAll(conn); !errors.Is(err, ErrInvalidModification) {
+			t.Errorf("got %v", err)
+		}
+		if mc.written.Len() != 0 {
+			t.Errorf("answered with %q", mc.written.String())
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		mc := &mockConn{readData: []byte(
+			"GET /closed HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+				"GET /ok HTTP/1.1\r\nHost: example.com\r\n\r\n")}
+		conn := newInspectedConn(mc, Config{OnRequest: reject}, false)
+		data, err := io.ReadAll(conn)
+		if err != nil || len(data) != 0 {
+			t.Fatalf("got %q, %v", data, err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(&mc.written), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 429 || !resp.Close {
+			t.Errorf("got %s, close %v", resp.Status, resp.Close)
+		}
+	})
+}
@@ -0,0 +1,197 @@
+package httpinspector
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Values substituted for identifying headers by the privacy preset. The
+// User-Agent is the one the I2P HTTP proxy sends.
+const (
+	PrivacyUserAgent      = "MYOB/6.66 (AN/ON)"
+	PrivacyAcceptLanguage = "en-US,en;q=0.5"
+)
+
+// PrivacyOptions selects what the privacy preset scrubs from HTTP messages.
+// Each field enables one behavior.
+type PrivacyOptions struct {
+	// UserAgent replaces the User-Agent of requests with PrivacyUserAgent.
+	UserAgent bool
+	// AcceptLanguage replaces the Accept-Language of requests with
+	// PrivacyAcceptLanguage.
+	AcceptLanguage bool
+	// ClientHints removes the User-Agent client hints, Sec-CH-UA and every
+	// Sec-CH-UA-* field, from requests, since they name the browser, its
+	// version and platform as User-Agent does. Accept-CH and Critical-CH are
+	// removed from responses, so that servers cannot ask for more hints.
+	ClientHints bool
+	// ForwardedFor removes the header fields proxies use to pass on client
+	// addresses: X-Forwarded-For, Forwarded, X-Real-IP and Client-IP.
+	ForwardedFor bool
+	// Via removes Via from requests and responses.
+	Via bool
+	// Referer removes the Referer of requests when it names another origin.
+	Referer bool
+	// ETag removes ETag from responses and If-None-Match from requests, so
+	// that entity tags cannot be used as tracking identifiers.
+	ETag bool
+	// Date removes Date from requests and replaces the Date of responses
+	// with the current time rounded down to the minute, hiding the clock
+	// skew of the server.
+	Date bool
+	// Server removes software banners from responses: Server, X-Powered-By,
+	// X-AspNet-Version and X-AspNetMvc-Version.
+	Server bool
+	// SameSite adds SameSite=Lax to cookies set without a SameSite
+	// attribute.
+	SameSite bool
+
+	now func() time.Time // Clock for the Date behavior; time.Now if nil
+}
+
+// DefaultPrivacyOptions returns PrivacyOptions with every behavior enabled.
+func DefaultPrivacyOptions() PrivacyOptions {
+	return PrivacyOptions{
+		UserAgent:      true,
+		AcceptLanguage: true,
+		ClientHints:    true,
+		ForwardedFor:   true,
+		Via:            true,
+		Referer:        true,
+		ETag:           true,
+		Date:           true,
+		Server:         true,
+		SameSite:       true,
+	}
+}
+
+// PrivacyConfig returns a Config that strips identifying information from
+// requests and responses, with every behavior of PrivacyOptions enabled.
+func PrivacyConfig() Config {
+	return DefaultPrivacyOptions().Config()
+}
+
+// Config returns a Config applying the selected behaviors.
+func (o PrivacyOptions) Config() Config {
+	return Config{
+		OnRequest:  o.ScrubRequest,
+		OnResponse: o.ScrubResponse,
+	}
+}
+
+// ScrubRequest applies the selected behaviors to req. It can be called from
+// another RequestCallback to combine the preset with other inspection.
+func (o PrivacyOptions) ScrubRequest(req *http.Request) error {
+	h := req.Header
+	if o.UserAgent && h.Get("User-Agent") != "" {
+		h.Set("User-Agent", PrivacyUserAgent)
+	}
+	if o.AcceptLanguage && h.Get("Accept-Language") != "" {
+		h.Set("Accept-Language", PrivacyAcceptLanguage)
+	}
+	if o.ClientHints {
+		for name := range h {
+			if key := http.CanonicalHeaderKey(name); key == "Sec-Ch-Ua" || strings.HasPrefix(key, "Sec-Ch-Ua-") {
+				delete(h, name)
+			}
+		}
+	}
+	if o.ForwardedFor {
+		removeForwarded(h)
+	}
+	if o.Via {
+		h.Del("Via")
+	}
+	if o.Referer && crossOrigin(req, h.Get("Referer")) {
+		h.Del("Referer")
+	}
+	if o.ETag {
+		h.Del("If-None-Match")
+	}
+	if o.Date {
+		h.Del("Date")
+	}
+	return nil
+}
+
+// ScrubResponse applies the selected behaviors to resp. It can be called
+// from another ResponseCallback to combine the preset with other inspection.
+func (o PrivacyOptions) ScrubResponse(resp *http.Response) error {
+	h := resp.Header
+	if o.ClientHints {
+		h.Del("Accept-CH")
+		h.Del("Critical-CH")
+	}
+	if o.ForwardedFor {
+		removeForwarded(h)
+	}
+	if o.Via {
+		h.Del("Via")
+	}
+	if o.ETag {
+		h.Del("ETag")
+	}
+	if o.Date && h.Get("Date") != "" {
+		now := time.Now
+		if o.now != nil {
+			now = o.now
+		}
+		h.Set("Date", now().UTC().Truncate(time.Minute).Format(http.TimeFormat))
+	}
+	if o.Server {
+		for _, name := range []string{"Server", "X-Powered-By", "X-AspNet-Version", "X-AspNetMvc-Version"} {
+			h.Del(name)
+		}
+	}
+	if o.SameSite {
+		cookies := h["Set-Cookie"]
+		for i, c := range cookies {
+			if !hasCookieAttr(c, "SameSite") {
+				cookies[i] = c + "; SameSite=Lax"
+			}
+		}
+	}
+	return nil
+}
+
+func removeForwarded(h http.Header) {
+	for _, name := range []string{"X-Forwarded-For", "Forwarded", "X-Real-IP", "Client-IP"} {
+		h.Del(name)
+	}
+}
+
+// crossOrigin reports whether the referer names an origin other than the
+// one req is addressed to. Referers that cannot be parsed count as cross
+// origin.
+func crossOrigin(req *http.Request, referer string) bool {
+	if referer == "" {
+		return false
+	}
+	ref, err := url.Parse(referer)
+	if err != nil {
+		return true
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if req.URL.Scheme != "" && !strings.EqualFold(ref.Scheme, req.URL.Scheme) {
+		return true
+	}
+	return !strings.EqualFold(ref.Host, host)
+}
+
+// hasCookieAttr reports whether the Set-Cookie value has the named
+// attribute.
+func hasCookieAttr(setCookie, name string) bool {
+	attrs := strings.Split(setCookie, ";")
+	for _, attr := range attrs[1:] {
+		attr, _, _ = strings.Cut(attr, "=")
+		if strings.EqualFold(strings.TrimSpace(attr), name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package httpinspector
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// scrubFixtures passes the requests and server response in testdata through
+// an inspector configured with o, and parses the results. The fixtures
+// follow the header fields, order and values of Firefox 128, Chrome 126 and
+// nginx 1.24, with the fields proxies add, but were written by hand rather
+// than captured.
+func scrubFixtures(t *testing.T, o PrivacyOptions) (firefox, chrome *http.Request, resp *http.Response) {
+	t.Helper()
+	o.now = func() time.Time { return time.Date(2024, 10, 15, 9, 40, 59, 0, time.UTC) }
+	read := func(name string) []byte {
+		b, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	mc := &mockConn{readData: append(read("firefox-request.http"), read("chrome-request.http")...)}
+	conn := newInspectedConn(mc, o.Config(), false)
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := readRequests(t, string(data))
+	if len(reqs) != 2 {
+		t.Fatalf("got %d requests", len(reqs))
+	}
+	if _, err := conn.Write(read("nginx-response.http")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(mc.written.Bytes())), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reqs[0], reqs[1], resp
+}
+
+func TestPrivacyConfig(t *testing.T) {
+	firefox, chrome, resp := scrubFixtures(t, DefaultPrivacyOptions())
+
+	for _, req := range []*http.Request{firefox, chrome} {
+		if got := req.UserAgent(); got != PrivacyUserAgent {
+			t.Errorf("User-Agent %q", got)
+		}
+		if got := req.Header.Get("Accept-Language"); got != PrivacyAcceptLanguage {
+			t.Errorf("Accept-Language %q", got)
+		}
+		for _, name := range []string{"X-Forwarded-For", "Via", "If-None-Match", "Sec-CH-UA", "Sec-CH-UA-Mobile", "Sec-CH-UA-Platform"} {
+			if v := req.Header.Get(name); v != "" {
+				t.Errorf("%s %q kept", name, v)
+			}
+		}
+		if req.Header.Get("Accept") == "" {
+			t.Error("Accept removed")
+		}
+	}
+	if got := firefox.Referer(); got != "" {
+		t.Errorf("cross-origin Referer %q kept", got)
+	}
+	if got := chrome.Referer(); got != "http://blog.i2p/posts/hello-world" {
+		t.Errorf("same-origin Referer became %q", got)
+	}
+	if body, _ := io.ReadAll(chrome.Body); string(body) != `{"text":"nice post, thanks"}` {
+		t.Errorf("request body %q", body)
+	}
+
+	for _, name := range []string{"Server", "X-Powered-By", "ETag", "Via", "Accept-CH"} {
+		if v := resp.Header.Get(name); v != "" {
+			t.Errorf("%s %q kept", name, v)
+		}
+	}
+	if got := resp.Header.Get("Date"); got != "Tue, 15 Oct 2024 09:40:00 GMT" {
+		t.Errorf("Date %q", got)
+	}
+	cookies := resp.Header.Values("Set-Cookie")
+	if len(cookies) != 2 ||
+		cookies[0] != "PHPSESSID=r2t5uvjq435r4q7ib3vtdjq120; path=/; HttpOnly; SameSite=Lax" ||
+		cookies[1] != "theme=dark; Path=/; Max-Age=31536000; SameSite=Strict" {
+		t.Errorf("Set-Cookie %q", cookies)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "<html>hello</html>\r\n" {
+		t.Errorf("response body %q", body)
+	}
+}
+
+func TestPrivacyOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		disable func(*PrivacyOptions)
+		kept    func(firefox, chrome *http.Request, resp *http.Response) bool
+	}{
+		{"UserAgent", func(o *PrivacyOptions) { o.UserAgent = false },
+			func(f, c *http.Request, r *http.Response) bool {
+				return f.UserAgent() == "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+			}},
+		{"AcceptLanguage", func(o *PrivacyOptions) { o.AcceptLanguage = false },
+			func(f, c *http.Request, r *http.Response) bool {
+				return c.Header.Get("Accept-Language") == "fr-FR,fr;q=0.9,en-US;q=0.8,en;q=0.7"
+			}},
+		{"ClientHints", func(o *PrivacyOptions) { o.ClientHints = false },
+			func(f, c *http.Request, r *http.Response) bool {
+				return c.Header.Get("Sec-CH-UA-Platform") == `"Windows"` && c.Header.Get("Sec-CH-UA-Mobile") == "?0" &&
+					c.Header.Get("Sec-CH-UA") != "" && r.Header.Get("Accept-CH") != ""
+			}},
+		{"ForwardedFor", func(o *PrivacyOptions) { o.ForwardedFor = false },
+			func(f, c *http.Request, r *http.Response) bool { return c.Header.Get("X-Forwarded-For") == "10.8.0.14" }},
+		{"Via", func(o *PrivacyOptions) { o.Via = false },
+			func(f, c *http.Request, r *http.Response) bool {
+				return c.Header.Get("Via") != "" && r.Header.Get("Via") == "1.1 varnish"
+			}},
+		{"Referer", func(o *PrivacyOptions) { o.Referer = false },
+			func(f, c *http.Request, r *http.Response) bool { return f.Referer() == "http://search.i2p/?q=forum" }},
+		{"ETag", func(o *PrivacyOptions) { o.ETag = false },
+			func(f, c *http.Request, r *http.Response) bool {
+				return f.Header.Get("If-None-Match") != "" && r.Header.Get("ETag") == `"5d8c72a5edda8"`
+			}},
+		{"Date", func(o *PrivacyOptions) { o.Date = false },
+			func(f, c *http.Request, r *http.Response) bool {
+				return r.Header.Get("Date") == "Tue, 15 Oct 2024 09:41:27 GMT"
+			}},
+		{"Server", func(o *PrivacyOptions) { o.Server = false },
+			func(f, c *http.Request, r *http.Response) bool {
+				return r.Header.Get("Server") == "nginx/1.24.0 (Ubuntu)" && r.Header.Get("X-Powered-By") != ""
+			}},
+		{"SameSite", func(o *PrivacyOptions) { o.SameSite = false },
+			func(f, c *http.Request, r *http.Response) bool {
+				return r.Header.Get("Set-Cookie") == "PHPSESSID=r2t5uvjq435r4q7ib3vtdjq120; path=/; HttpOnly"
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := DefaultPrivacyOptions()
+			tt.disable(&o)
+			firefox, chrome, resp := scrubFixtures(t, o)
+			if !tt.kept(firefox, chrome, resp) {
+				t.Errorf("disabled behavior still applied")
+			}
+			// Everything else is still scrubbed.
+			if tt.name != "UserAgent" && chrome.UserAgent() != PrivacyUserAgent {
+				t.Errorf("User-Agent %q", chrome.UserAgent())
+			}
+			if tt.name != "Server" && resp.Header.Get("Server") != "" {
+				t.Errorf("Server %q", resp.Header.Get("Server"))
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package httpinspector
+
+import (
+	"io"
+	"sync"
+)
+
+// bodyPump drives a streaming body transformer. The transformer reads the
+// body from an io.Reader and returns another reader, so it runs in its own
+// goroutine; the pump keeps the connection synchronous by making feed wait
+// until the transformer has consumed its input and asks for more (or has
+// finished), returning the output produced in the meantime.
+type bodyPump struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	in      []byte
+	closed  bool // No more input will be fed
+	waiting bool // The transformer is blocked waiting for input
+	out     []byte
+	done    bool // The transformed body has ended
+	err     error
+}
+
+func newBodyPump() *bodyPump {
+	p := &bodyPump{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// reader returns the reader the transformer consumes the body from.
+func (p *bodyPump) reader() io.Reader {
+	return pumpReader{p}
+}
+
+// start runs the pump, reading the transformed body from r.
+func (p *bodyPump) start(r io.Reader) {
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buf)
+			p.mu.Lock()
+			p.out = append(p.out, buf[:n]...)
+			if err != nil {
+				if err != io.EOF {
+					p.err = err
+				}
+				p.done = true
+				p.cond.Broadcast()
+				p.mu.Unlock()
+				return
+			}
+			p.mu.Unlock()
+		}
+	}()
+}
+
+// feed passes more of the body to the transformer and returns the output it
+// has produced. When final is set it waits for the transformed body to end.
+func (p *bodyPump) feed(b []byte, final bool) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.in = append(p.in, b...)
+	if final {
+		p.closed = true
+	}
+	p.cond.Broadcast()
+	for !p.done && (final || !p.waiting || len(p.in) > 0) {
+		p.cond.Wait()
+	}
+	out := p.out
+	p.out = nil
+	return out, p.err
+}
+
+// abort ends the input without waiting for the transformer, so that its
+// goroutine finishes when the connection goes away mid-body.
+func (p *bodyPump) abort() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// pumpReader is the transformer's view of the body.
+type pumpReader struct {
+	p *bodyPump
+}
+
+func (r pumpReader) Read(b []byte) (int, error) {
+	p := r.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.in) == 0 && !p.closed {
+		p.waiting = true
+		p.cond.Broadcast()
+		p.cond.Wait()
+	}
+	p.waiting = false
+	if len(p.in) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, p.in)
+	p.in = p.in[n:]
+	return n, nil
+}
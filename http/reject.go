@@ -0,0 +1,92 @@
+package httpinspector
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+// Reject is an error a RequestCallback returns to block a request. The
+// inspector answers the request itself with the described response, and the
+// request never reaches its destination. The connection stays open for
+// further requests unless Close is set or the request cannot be skipped
+// cleanly.
+type Reject struct {
+	Status  int         // Status code of the response; 403 Forbidden if zero
+	Body    []byte      // Response body; the status text if nil, none for 204 and 304
+	Headers http.Header // Additional response header fields
+	Close   bool        // Close the connection after the response
+}
+
+// Error implements the error interface.
+func (r *Reject) Error() string {
+	return fmt.Sprintf("request rejected with status %d", r.status())
+}
+
+func (r *Reject) status() int {
+	if r.Status == 0 {
+		return http.StatusForbidden
+	}
+	return r.Status
+}
+
+// check returns an error wrapping ErrInvalidModification if r cannot answer
+// a request: interim 1xx responses do not, and status codes have three
+// digits.
+func (r *Reject) check() error {
+	if status := r.status(); status < 200 || status > 999 {
+		return fmt.Errorf("%w: rejected with status %d", ErrInvalidModification, status)
+	}
+	return nil
+}
+
+// bodyless reports whether the response has no body, whatever its header
+// says: a client reads the next response right after the header of a 204
+// or 304.
+func (r *Reject) bodyless() bool {
+	status := r.status()
+	return status == http.StatusNoContent || status == http.StatusNotModified
+}
+
+// build returns the response described by r, and its body.
+func (r *Reject) build() (*http.Response, []byte) {
+	resp := &http.Response{
+		StatusCode: r.status(),
+		Header:     r.Headers.Clone(),
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	if r.bodyless() {
+		resp.Header.Del("Content-Length")
+		resp.Header.Del("Transfer-Encoding")
+		return resp, nil
+	}
+	body := r.Body
+	if body == nil {
+		body = []byte(http.StatusText(resp.StatusCode) + "\n")
+	}
+	if len(body) > 0 && resp.Header.Get("Content-Type") == "" {
+		resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	return resp, body
+}
+
+// response serializes the response answering req.
+func (r *Reject) response(req *http.Request, close bool) []byte {
+	resp, body := r.build()
+	resp.Proto = "HTTP/1.1"
+	if close {
+		resp.Header.Set("Connection", "close")
+	}
+	var buf bytes.Buffer
+	if r.bodyless() {
+		writeResponseHead(&buf, resp, frameNone, 0)
+		return buf.Bytes()
+	}
+	writeResponseHead(&buf, resp, frameLength, int64(len(body)))
+	if req.Method != http.MethodHead {
+		buf.Write(body)
+	}
+	return buf.Bytes()
+}
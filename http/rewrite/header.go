@@ -0,0 +1,131 @@
+package rewrite
+
+import (
+	"net/http"
+	"strings"
+)
+
+// RewriteHeader rewrites the internal origins named in the fields of a
+// response header.
+func (r *Rewriter) RewriteHeader(h http.Header) {
+	for _, name := range []string{"Location", "Content-Location", "Access-Control-Allow-Origin"} {
+		rewriteValues(h, name, r.URL)
+	}
+	rewriteValues(h, "Refresh", r.Refresh)
+	rewriteValues(h, "Link", r.Link)
+	rewriteValues(h, "Content-Security-Policy", r.CSP)
+	rewriteValues(h, "Content-Security-Policy-Report-Only", r.CSP)
+	rewriteValues(h, "Set-Cookie", r.SetCookie)
+}
+
+func rewriteValues(h http.Header, name string, rewrite func(string) string) {
+	values := h.Values(name)
+	for i, v := range values {
+		values[i] = rewrite(v)
+	}
+}
+
+// Refresh rewrites the URL of a Refresh header field or <meta> refresh tag,
+// such as "5; url=http://127.0.0.1:8080/".
+func (r *Rewriter) Refresh(v string) string {
+	i := strings.Index(strings.ToLower(v), "url=")
+	if i < 0 {
+		return v
+	}
+	i += len("url=")
+	u := v[i:]
+	quote := ""
+	if u != "" && (u[0] == '"' || u[0] == '\'') {
+		quote, u = u[:1], u[1:]
+	}
+	return v[:i] + quote + r.URL(u)
+}
+
+// Link rewrites the URL references of a Link header field.
+func (r *Rewriter) Link(v string) string {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(v, '<')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(v[i:], '>')
+		if j < 0 {
+			break
+		}
+		j += i
+		b.WriteString(v[:i+1])
+		b.WriteString(r.URL(v[i+1 : j]))
+		v = v[j:]
+	}
+	b.WriteString(v)
+	return b.String()
+}
+
+// CSP rewrites the sources of a Content-Security-Policy. Host sources
+// without a scheme, such as "127.0.0.1:8080", are rewritten for any internal
+// origin with that host.
+func (r *Rewriter) CSP(v string) string {
+	directives := strings.Split(v, ";")
+	for i, d := range directives {
+		tokens := strings.Split(d, " ")
+		// The first token is the directive name.
+		named := false
+		for j, t := range tokens {
+			if t == "" {
+				continue
+			}
+			if !named {
+				named = true
+				continue
+			}
+			tokens[j] = r.source(t)
+		}
+		directives[i] = strings.Join(tokens, " ")
+	}
+	return strings.Join(directives, ";")
+}
+
+// source rewrites a source expression of a Content-Security-Policy.
+func (r *Rewriter) source(s string) string {
+	if strings.HasPrefix(s, "'") {
+		return s
+	}
+	if strings.Contains(s, "://") {
+		return r.URL(s)
+	}
+	if strings.HasSuffix(s, ":") {
+		return s // A scheme source
+	}
+	if u := r.URL("//" + s); u != "//"+s {
+		return u[2:]
+	}
+	return s
+}
+
+// SetCookie rewrites the Domain attribute of a Set-Cookie header field that
+// names the host of an internal origin. Other attributes are left as they
+// are.
+func (r *Rewriter) SetCookie(v string) string {
+	attrs := strings.Split(v, ";")
+	for i, attr := range attrs[1:] {
+		name, value, ok := strings.Cut(attr, "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "Domain") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		dot := strings.HasPrefix(value, ".")
+		domain := strings.ToLower(strings.TrimPrefix(value, "."))
+		for _, m := range r.mappings {
+			if hostname(m.from.host) == domain {
+				domain = hostname(m.to.host)
+				if dot {
+					domain = "." + domain
+				}
+				attrs[i+1] = name + "=" + domain
+				break
+			}
+		}
+	}
+	return strings.Join(attrs, ";")
+}
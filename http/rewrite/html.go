@@ -0,0 +1,151 @@
+package rewrite
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// urlAttributes are the attributes holding a single URL.
+var urlAttributes = map[string]bool{
+	"action":     true,
+	"background": true,
+	"cite":       true,
+	"codebase":   true,
+	"data":       true,
+	"formaction": true,
+	"href":       true,
+	"icon":       true,
+	"longdesc":   true,
+	"manifest":   true,
+	"poster":     true,
+	"src":        true,
+	"xlink:href": true,
+}
+
+// textAttributes are the attributes holding lists of URLs or CSS.
+var textAttributes = map[string]bool{
+	"imagesrcset": true,
+	"ping":        true,
+	"srcset":      true,
+	"style":       true,
+}
+
+// HTML returns a reader producing the HTML document read from src with its
+// internal origins rewritten. Each token is produced as soon as it has been
+// read, so the document keeps streaming.
+func (r *Rewriter) HTML(src io.Reader) io.Reader {
+	return &htmlReader{r: r, z: xhtml.NewTokenizer(src)}
+}
+
+// htmlReader rewrites an HTML document token by token. Tokens it does not
+// change are copied as they were read.
+type htmlReader struct {
+	r     *Rewriter
+	z     *xhtml.Tokenizer
+	out   bytes.Buffer
+	raw   []byte
+	style bool // The last token started a <style> element
+	err   error
+}
+
+func (h *htmlReader) Read(b []byte) (int, error) {
+	for h.out.Len() == 0 {
+		if h.err != nil {
+			return 0, h.err
+		}
+		h.next()
+	}
+	return h.out.Read(b)
+}
+
+// next rewrites the next token into out.
+func (h *htmlReader) next() {
+	tt := h.z.Next()
+	style := h.style
+	h.style = false
+	switch tt {
+	case xhtml.ErrorToken:
+		h.out.Write(h.z.Raw())
+		h.err = h.z.Err()
+	case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+		h.tag(tt == xhtml.SelfClosingTagToken)
+	case xhtml.TextToken:
+		if style {
+			h.out.WriteString(h.r.Text(string(h.z.Raw())))
+		} else {
+			h.out.Write(h.z.Raw())
+		}
+	default:
+		h.out.Write(h.z.Raw())
+	}
+}
+
+type attribute struct {
+	key, val string
+}
+
+// tag rewrites a start tag, which is copied as it was read unless one of its
+// attributes changes.
+func (h *htmlReader) tag(selfClosing bool) {
+	// Reading the name and attributes changes the raw token.
+	h.raw = append(h.raw[:0], h.z.Raw()...)
+	name, more := h.z.TagName()
+	tag := string(name)
+	h.style = tag == "style" && !selfClosing
+	var attrs []attribute
+	for more {
+		var key, val []byte
+		key, val, more = h.z.TagAttr()
+		attrs = append(attrs, attribute{string(key), string(val)})
+	}
+	changed := false
+	for i, a := range attrs {
+		val := a.val
+		switch {
+		case urlAttributes[a.key]:
+			val = h.r.URL(val)
+		case textAttributes[a.key]:
+			val = h.r.Text(val)
+		case a.key == "content" && tag == "meta":
+			switch strings.ToLower(attrValue(attrs, "http-equiv")) {
+			case "refresh":
+				val = h.r.Refresh(val)
+			case "content-security-policy", "content-security-policy-report-only":
+				val = h.r.CSP(val)
+			}
+		}
+		if val != a.val {
+			attrs[i].val = val
+			changed = true
+		}
+	}
+	if !changed {
+		h.out.Write(h.raw)
+		return
+	}
+	h.out.WriteString("<" + tag)
+	for _, a := range attrs {
+		h.out.WriteString(" " + a.key)
+		if a.val != "" {
+			h.out.WriteString(`="` + html.EscapeString(a.val) + `"`)
+		}
+	}
+	if selfClosing {
+		h.out.WriteString("/>")
+	} else {
+		h.out.WriteString(">")
+	}
+}
+
+func attrValue(attrs []attribute, key string) string {
+	for _, a := range attrs {
+		if a.key == key {
+			return a.val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,287 @@
+// Package rewrite rewrites the origins named in HTTP responses, so that an
+// application serving itself on an internal origin can be published on
+// another one, such as an I2P hostname.
+//
+// A Rewriter is configured with a map from internal origins to public ones:
+//
+//	rw, err := rewrite.New(map[string]string{
+//		"http://127.0.0.1:8080": "http://example.i2p",
+//	})
+//	inspector := httpinspector.New(listener, rw.Config())
+//
+// It rewrites absolute and scheme-relative URLs naming an internal origin in
+// response header fields (Location, Content-Location, Refresh, Link,
+// Access-Control-Allow-Origin and Content-Security-Policy), the Domain of
+// cookies, and HTML bodies: link, form and media attributes, <base> tags,
+// srcset lists, inline styles and style sheets, and <meta> refresh and
+// Content-Security-Policy tags. HTML is rewritten as it streams through,
+// with a tokenizer; the markup of elements it does not change is forwarded
+// byte for byte.
+package rewrite
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	httpinspector "github.com/go-i2p/go-connfilter/http"
+)
+
+// ErrInvalidOrigin is returned for origin maps that cannot be used.
+var ErrInvalidOrigin = errors.New("invalid origin")
+
+// origin is a scheme and host, with the port only if it is not the default
+// one for the scheme.
+type origin struct {
+	scheme string
+	host   string
+}
+
+// mapping maps an internal origin to a public one.
+type mapping struct {
+	from, to origin
+}
+
+// Rewriter rewrites internal origins to public ones.
+type Rewriter struct {
+	mappings []mapping
+}
+
+// New returns a Rewriter for the origin map, whose keys are internal origins
+// and values the public origins to put in their place. Origins are http or
+// https URLs without a path, such as "http://127.0.0.1:8080".
+func New(origins map[string]string) (*Rewriter, error) {
+	r := &Rewriter{}
+	for from, to := range origins {
+		f, err := parseOrigin(from)
+		if err != nil {
+			return nil, err
+		}
+		t, err := parseOrigin(to)
+		if err != nil {
+			return nil, err
+		}
+		r.mappings = append(r.mappings, mapping{from: f, to: t})
+	}
+	// Scheme-relative URLs and cookies only name a host, which several
+	// internal origins may share; the first in this order wins.
+	sort.Slice(r.mappings, func(i, j int) bool {
+		a, b := r.mappings[i].from, r.mappings[j].from
+		if a.host != b.host {
+			return a.host < b.host
+		}
+		return a.scheme < b.scheme
+	})
+	return r, nil
+}
+
+func parseOrigin(s string) (origin, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return origin{}, fmt.Errorf("%w: %v", ErrInvalidOrigin, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" || u.User != nil ||
+		u.Path != "" && u.Path != "/" || u.RawQuery != "" || u.Fragment != "" {
+		return origin{}, fmt.Errorf("%w: %q", ErrInvalidOrigin, s)
+	}
+	return origin{scheme: u.Scheme, host: normalizeHost(u.Scheme, u.Host)}, nil
+}
+
+// normalizeHost lowercases host and removes the port if it is the default
+// one for scheme.
+func normalizeHost(scheme, host string) string {
+	host = strings.ToLower(host)
+	switch scheme {
+	case "http", "ws":
+		return strings.TrimSuffix(host, ":80")
+	case "https", "wss":
+		return strings.TrimSuffix(host, ":443")
+	}
+	return host
+}
+
+// Config returns an inspector configuration rewriting the header and body of
+// every response. Bodies are decoded for the rewriter, so that compressed
+// HTML is rewritten too.
+func (r *Rewriter) Config() httpinspector.Config {
+	return httpinspector.Config{
+		OnResponse:            r.OnResponse,
+		OnResponseBody:        r.OnResponseBody,
+		DecodeContentEncoding: true,
+	}
+}
+
+// OnResponse rewrites the header of resp. It can be called from another
+// ResponseCallback to combine the rewriter with other inspection.
+func (r *Rewriter) OnResponse(resp *http.Response) error {
+	r.RewriteHeader(resp.Header)
+	return nil
+}
+
+// OnResponseBody rewrites HTML bodies. Other bodies, and bodies that carry a
+// content coding the inspector did not decode, are left alone.
+func (r *Rewriter) OnResponseBody(resp *http.Response, body io.Reader) io.Reader {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil
+	}
+	if encoded(resp.Header) && !httpinspector.BodyDecoded(body) {
+		return nil
+	}
+	return r.HTML(body)
+}
+
+// encoded reports whether h names a content coding other than identity.
+func encoded(h http.Header) bool {
+	for _, v := range h.Values("Content-Encoding") {
+		for _, c := range strings.Split(v, ",") {
+			if c = strings.TrimSpace(c); c != "" && !strings.EqualFold(c, "identity") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// URL returns s with its origin rewritten, if it is an absolute or
+// scheme-relative URL naming an internal origin, and s otherwise. WebSocket
+// URLs are rewritten as the http or https URLs they correspond to.
+func (r *Rewriter) URL(s string) string {
+	rest := strings.TrimLeft(s, " \t\n\f\r")
+	lead := s[:len(s)-len(rest)]
+	scheme := ""
+	if i := strings.Index(rest, "://"); i > 0 && isScheme(rest[:i]) {
+		scheme, rest = strings.ToLower(rest[:i]), rest[i+3:]
+	} else if strings.HasPrefix(rest, "//") {
+		rest = rest[2:]
+	} else {
+		return s
+	}
+	end := strings.IndexAny(rest, "/?#\\")
+	if end < 0 {
+		end = len(rest)
+	}
+	authority, path := rest[:end], rest[end:]
+	userinfo := ""
+	if i := strings.LastIndexByte(authority, '@'); i >= 0 {
+		userinfo, authority = authority[:i+1], authority[i+1:]
+	}
+	m, ok := r.match(scheme, authority)
+	if !ok {
+		return s
+	}
+	if scheme == "" {
+		return lead + "//" + userinfo + m.to.host + path
+	}
+	return lead + m.toScheme(scheme) + "://" + userinfo + m.to.host + path
+}
+
+// match returns the mapping for an origin. Without a scheme, any mapping for
+// the host matches.
+func (r *Rewriter) match(scheme, host string) (mapping, bool) {
+	httpScheme := scheme
+	switch scheme {
+	case "ws":
+		httpScheme = "http"
+	case "wss":
+		httpScheme = "https"
+	case "", "http", "https":
+	default:
+		return mapping{}, false
+	}
+	for _, m := range r.mappings {
+		if scheme == "" {
+			if normalizeHost(m.from.scheme, host) == m.from.host {
+				return m, true
+			}
+		} else if httpScheme == m.from.scheme && normalizeHost(scheme, host) == m.from.host {
+			return m, true
+		}
+	}
+	return mapping{}, false
+}
+
+// toScheme returns the public scheme to use in place of scheme.
+func (m mapping) toScheme(scheme string) string {
+	if scheme == "ws" || scheme == "wss" {
+		if m.to.scheme == "https" {
+			return "wss"
+		}
+		return "ws"
+	}
+	return m.to.scheme
+}
+
+// hostname returns host without its port.
+func hostname(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+		return host[:i]
+	}
+	return host
+}
+
+func isScheme(s string) bool {
+	for i, c := range s {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case i > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Text rewrites the URLs found anywhere in s, such as in a style sheet or a
+// srcset list. URLs end at whitespace, quotes, parentheses and commas.
+func (r *Rewriter) Text(s string) string {
+	var b strings.Builder
+	done := 0
+	for i := 0; i+1 < len(s); {
+		j := strings.Index(s[i:], "//")
+		if j < 0 {
+			break
+		}
+		j += i
+		start := j
+		if j > 0 && s[j-1] == ':' {
+			// Back up over the scheme.
+			k := j - 1
+			for k > 0 && isSchemeByte(s[k-1]) {
+				k--
+			}
+			if !isScheme(s[k : j-1]) {
+				i = j + 2
+				continue
+			}
+			start = k
+		} else if j > 0 && !strings.ContainsRune(" \t\n\f\r\"'(,=", rune(s[j-1])) {
+			i = j + 2
+			continue
+		}
+		end := j + 2
+		for end < len(s) && !strings.ContainsRune(" \t\n\f\r\"'()<>,;", rune(s[end])) {
+			end++
+		}
+		if u := r.URL(s[start:end]); u != s[start:end] {
+			b.WriteString(s[done:start])
+			b.WriteString(u)
+			done = end
+		}
+		i = end
+	}
+	if done == 0 {
+		return s
+	}
+	b.WriteString(s[done:])
+	return b.String()
+}
+
+func isSchemeByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'
+}
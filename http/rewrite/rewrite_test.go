@@ -0,0 +1,283 @@
+package rewrite
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	httpinspector "github.com/go-i2p/go-connfilter/http"
+)
+
+func newTestRewriter(t *testing.T) *Rewriter {
+	t.Helper()
+	r, err := New(map[string]string{
+		"http://127.0.0.1:8080":    "http://example.i2p",
+		"https://app.internal":     "http://abcdefgh.b32.i2p",
+		"http://app.internal:8000": "http://other.i2p/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestInvalidOrigins(t *testing.T) {
+	for _, origin := range []string{"127.0.0.1:8080", "ftp://host", "http://host/path", "http://user@host", "http://", "http://host?q"} {
+		if _, err := New(map[string]string{origin: "http://example.i2p"}); !errors.Is(err, ErrInvalidOrigin) {
+			t.Errorf("%q: got %v", origin, err)
+		}
+		if _, err := New(map[string]string{"http://host": origin}); !errors.Is(err, ErrInvalidOrigin) {
+			t.Errorf("%q as public origin: got %v", origin, err)
+		}
+	}
+}
+
+func TestURL(t *testing.T) {
+	r := newTestRewriter(t)
+	tests := []struct{ in, want string }{
+		{"http://127.0.0.1:8080/a?b#c", "http://example.i2p/a?b#c"},
+		{"HTTP://127.0.0.1:8080", "http://example.i2p"},
+		{"http://127.0.0.1:8080?q", "http://example.i2p?q"},
+		{"  http://127.0.0.1:8080/", "  http://example.i2p/"},
+		{"http://user:pw@127.0.0.1:8080/", "http://user:pw@example.i2p/"},
+		{"https://APP.internal:443/x", "http://abcdefgh.b32.i2p/x"},
+		{"wss://app.internal/socket", "ws://abcdefgh.b32.i2p/socket"},
+		{"ws://127.0.0.1:8080/socket", "ws://example.i2p/socket"},
+		{"//127.0.0.1:8080/x", "//example.i2p/x"},
+		{"http://app.internal:8000/", "http://other.i2p/"},
+		{"http://app.internal/", "http://app.internal/"},
+		{"https://127.0.0.1:8080/", "https://127.0.0.1:8080/"},
+		{"http://127.0.0.1:8081/", "http://127.0.0.1:8081/"},
+		{"http://127.0.0.1:80800/", "http://127.0.0.1:80800/"},
+		{"/relative", "/relative"},
+		{"mailto:x@127.0.0.1:8080", "mailto:x@127.0.0.1:8080"},
+		{"javascript://127.0.0.1:8080/", "javascript://127.0.0.1:8080/"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := r.URL(tt.in); got != tt.want {
+			t.Errorf("URL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteHeader(t *testing.T) {
+	r := newTestRewriter(t)
+	h := http.Header{
+		"Location":                    {"http://127.0.0.1:8080/login"},
+		"Content-Location":            {"/index.html"},
+		"Refresh":                     {"3; url=https://app.internal/next"},
+		"Link":                        {"<http://127.0.0.1:8080/style.css>; rel=preload, <https://cdn.example/x.js>; rel=preload"},
+		"Access-Control-Allow-Origin": {"http://127.0.0.1:8080"},
+		"Content-Security-Policy": {
+			"default-src 'self' http://127.0.0.1:8080; img-src app.internal https://app.internal/img/ data:; report-uri http://127.0.0.1:8080/csp",
+		},
+		"Set-Cookie": {
+			"session=1; Domain=.app.internal; Path=/; Secure",
+			"id=2; domain=127.0.0.1; HttpOnly",
+			"other=3; Domain=example.com",
+		},
+	}
+	r.RewriteHeader(h)
+	want := http.Header{
+		"Location":                    {"http://example.i2p/login"},
+		"Content-Location":            {"/index.html"},
+		"Refresh":                     {"3; url=http://abcdefgh.b32.i2p/next"},
+		"Link":                        {"<http://example.i2p/style.css>; rel=preload, <https://cdn.example/x.js>; rel=preload"},
+		"Access-Control-Allow-Origin": {"http://example.i2p"},
+		"Content-Security-Policy": {
+			"default-src 'self' http://example.i2p; img-src abcdefgh.b32.i2p http://abcdefgh.b32.i2p/img/ data:; report-uri http://example.i2p/csp",
+		},
+		"Set-Cookie": {
+			"session=1; Domain=.abcdefgh.b32.i2p; Path=/; Secure",
+			"id=2; domain=example.i2p; HttpOnly",
+			"other=3; Domain=example.com",
+		},
+	}
+	for name, values := range want {
+		if got := strings.Join(h[name], "\n"); got != strings.Join(values, "\n") {
+			t.Errorf("%s: got %q, want %q", name, got, values)
+		}
+	}
+}
+
+const testPage = `<!DOCTYPE html>
+<html><head>
+<base href="http://127.0.0.1:8080/">
+<meta http-equiv="refresh" content="30; URL='http://127.0.0.1:8080/refresh'">
+<meta http-equiv="Content-Security-Policy" content="script-src https://app.internal">
+<meta name="description" content="see http://127.0.0.1:8080/">
+<link rel=stylesheet href=http://127.0.0.1:8080/style.css>
+<style>body { background: url("https://app.internal/bg.png") } a { color: red }</style>
+<script>var api = "http://127.0.0.1:8080/api";</script>
+</head><body>
+<!-- http://127.0.0.1:8080/comment -->
+<A HREF="http://127.0.0.1:8080/a?x=1&amp;y=2" Class=link>Visit http://127.0.0.1:8080/</A>
+<a href="https://example.com/">elsewhere</a>
+<img src="//127.0.0.1:8080/img.png" srcset="http://127.0.0.1:8080/1x.png 1x, /2x.png 2x" alt="">
+<form action="https://app.internal/post" method=post><button formaction="http://127.0.0.1:8080/alt" disabled>Go</button></form>
+<div style="background-image:url(http://127.0.0.1:8080/d.png)"></div>
+<svg><image xlink:href="http://127.0.0.1:8080/s.svg"/></svg>
+</body></html>
+`
+
+const wantPage = `<!DOCTYPE html>
+<html><head>
+<base href="http://example.i2p/">
+<meta http-equiv="refresh" content="30; URL=&#39;http://example.i2p/refresh&#39;">
+<meta http-equiv="Content-Security-Policy" content="script-src http://abcdefgh.b32.i2p">
+<meta name="description" content="see http://127.0.0.1:8080/">
+<link rel="stylesheet" href="http://example.i2p/style.css">
+<style>body { background: url("http://abcdefgh.b32.i2p/bg.png") } a { color: red }</style>
+<script>var api = "http://127.0.0.1:8080/api";</script>
+</head><body>
+<!-- http://127.0.0.1:8080/comment -->
+<a href="http://example.i2p/a?x=1&amp;y=2" class="link">Visit http://127.0.0.1:8080/</A>
+<a href="https://example.com/">elsewhere</a>
+<img src="//example.i2p/img.png" srcset="http://example.i2p/1x.png 1x, /2x.png 2x" alt>
+<form action="http://abcdefgh.b32.i2p/post" method="post"><button formaction="http://example.i2p/alt" disabled>Go</button></form>
+<div style="background-image:url(http://example.i2p/d.png)"></div>
+<svg><image xlink:href="http://example.i2p/s.svg"/></svg>
+</body></html>
+`
+
+func TestHTML(t *testing.T) {
+	r := newTestRewriter(t)
+	for name, src := range map[string]io.Reader{
+		"Whole":   strings.NewReader(testPage),
+		"OneByte": iotest.OneByteReader(strings.NewReader(testPage)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := io.ReadAll(r.HTML(src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != wantPage {
+				t.Errorf("got\n%s", got)
+			}
+		})
+	}
+}
+
+// TestHTMLUnchanged checks that documents without internal origins pass
+// through byte for byte, however they end.
+func TestHTMLUnchanged(t *testing.T) {
+	r := newTestRewriter(t)
+	page := strings.ReplaceAll(testPage, "127.0.0.1:8080", "127.0.0.1:9")
+	page = strings.ReplaceAll(page, "app.internal", "app.example")
+	page += "<p title='unterminated"
+	for i := 0; i <= len(page); i++ {
+		got, err := io.ReadAll(r.HTML(strings.NewReader(page[:i])))
+		if err != nil || string(got) != page[:i] {
+			t.Fatalf("%d bytes: got %q, %v", i, got, err)
+		}
+	}
+}
+
+func TestInspector(t *testing.T) {
+	r := newTestRewriter(t)
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	io.WriteString(w, testPage)
+	w.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(httpinspector.New(l, r.Config()), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(compressed.Bytes())
+		case "/layered":
+			// The inspector decodes no more than one coding.
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "gzip, br")
+			w.Write(compressed.Bytes())
+		case "/corrupt":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", "gzip")
+			io.WriteString(w, testPage)
+		case "/text":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "http://127.0.0.1:8080/")
+		default:
+			http.Redirect(w, req, "http://127.0.0.1:8080/page", http.StatusFound)
+		}
+	}))
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	get := func(path string) (*http.Response, string) {
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: example.i2p\r\n\r\n", path)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			// Undecodable bodies are forwarded as they are.
+			if zr, err := gzip.NewReader(bytes.NewReader(b)); err == nil {
+				if b, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return resp, string(b)
+	}
+
+	if resp, _ := get("/"); resp.Header.Get("Location") != "http://example.i2p/page" {
+		t.Errorf("got Location %q", resp.Header.Get("Location"))
+	}
+	if resp, body := get("/page"); body != wantPage || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("got %v\n%s", resp.Header, body)
+	}
+	if _, body := get("/layered"); body != compressed.String() {
+		t.Errorf("encoded body rewritten: %q", body)
+	}
+	if _, body := get("/corrupt"); body != testPage {
+		t.Errorf("undecodable body rewritten: %q", body)
+	}
+	if _, body := get("/text"); body != "http://127.0.0.1:8080/" {
+		t.Errorf("text body rewritten: %q", body)
+	}
+}
+
+func TestOnResponseBodyEncoded(t *testing.T) {
+	// Without DecodeContentEncoding, the body reaches the callback encoded.
+	r := newTestRewriter(t)
+	for _, coding := range []string{"gzip", "identity, br", "GZIP"} {
+		resp := &http.Response{Header: http.Header{
+			"Content-Type":     {"text/html"},
+			"Content-Encoding": {coding},
+		}}
+		if r.OnResponseBody(resp, strings.NewReader(testPage)) != nil {
+			t.Errorf("%s body rewritten", coding)
+		}
+	}
+	resp := &http.Response{Header: http.Header{
+		"Content-Type":     {"text/html"},
+		"Content-Encoding": {"identity"},
+	}}
+	if r.OnResponseBody(resp, strings.NewReader(testPage)) == nil {
+		t.Error("identity body left alone")
+	}
+}
@@ -0,0 +1,465 @@
+// Package rules compiles declarative HTTP rule sets, loaded from YAML or
+// JSON, into httpinspector configurations.
+//
+// A rule set is an ordered list of rules. Each rule matches requests or
+// responses and applies its actions to every message it matches:
+//
+//	rules:
+//	  - name: block-admin
+//	    match:
+//	      method: [POST, PUT]
+//	      host: "*.example.com"
+//	      path: "/admin/*"
+//	    actions:
+//	      - block: 403
+//	  - name: hsts
+//	    phase: response
+//	    match:
+//	      status: [200]
+//	    actions:
+//	      - set_header: {Strict-Transport-Security: "max-age=31536000"}
+//
+// Rules are applied in order. A block or redirect action answers the
+// request immediately, so later rules and actions do not run for it.
+package rules
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	httpinspector "github.com/go-i2p/go-connfilter/http"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrInvalidRule is returned for rule sets that cannot be loaded or compiled.
+var ErrInvalidRule = errors.New("invalid HTTP rule")
+
+// Phases a rule can apply to.
+const (
+	PhaseRequest  = "request"
+	PhaseResponse = "response"
+)
+
+// RuleSet is an ordered list of rules.
+type RuleSet struct {
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+// Rule applies its actions to the messages it matches.
+type Rule struct {
+	Name    string   `json:"name" yaml:"name"`                       // Unique name, used for hit counters
+	Phase   string   `json:"phase,omitempty" yaml:"phase,omitempty"` // PhaseRequest (the default) or PhaseResponse
+	Match   Match    `json:"match" yaml:"match"`
+	Actions []Action `json:"actions" yaml:"actions"`
+}
+
+// Match describes the messages a rule applies to. Every condition given
+// must hold; an empty Match matches every message. Response rules match the
+// method, host and path of the request being answered.
+type Match struct {
+	Method    []string      `json:"method,omitempty" yaml:"method,omitempty"`         // Any of these methods
+	Host      string        `json:"host,omitempty" yaml:"host,omitempty"`             // Glob on the host, without port
+	Path      string        `json:"path,omitempty" yaml:"path,omitempty"`             // Glob on the URL path
+	PathRegex string        `json:"path_regex,omitempty" yaml:"path_regex,omitempty"` // Regexp on the URL path
+	Headers   []HeaderMatch `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Status    []int         `json:"status,omitempty" yaml:"status,omitempty"` // Any of these status codes; responses only
+}
+
+// HeaderMatch requires a header field to be present and, if Value or Regex
+// is set, to have a matching value.
+type HeaderMatch struct {
+	Name  string `json:"name" yaml:"name"`
+	Value string `json:"value,omitempty" yaml:"value,omitempty"` // Glob on the value
+	Regex string `json:"regex,omitempty" yaml:"regex,omitempty"` // Regexp on the value
+}
+
+// Action is one change a rule makes. Exactly one field must be set. Block,
+// Redirect and RewritePath apply to requests only.
+type Action struct {
+	SetHeader    map[string]string `json:"set_header,omitempty" yaml:"set_header,omitempty"`
+	AppendHeader map[string]string `json:"append_header,omitempty" yaml:"append_header,omitempty"`
+	RemoveHeader []string          `json:"remove_header,omitempty" yaml:"remove_header,omitempty"`
+
+	// RewritePath replaces the URL path. With Match.PathRegex, it replaces
+	// the text the regexp matches and may refer to submatches as $1.
+	RewritePath string `json:"rewrite_path,omitempty" yaml:"rewrite_path,omitempty"`
+
+	// Block answers the request with this status code, a 4xx or 5xx one.
+	Block int `json:"block,omitempty" yaml:"block,omitempty"`
+
+	Redirect *Redirect `json:"redirect,omitempty" yaml:"redirect,omitempty"`
+}
+
+// Redirect answers the request with a redirect to Location. With
+// Match.PathRegex, Location may refer to submatches of the path as $1.
+type Redirect struct {
+	Location string `json:"location" yaml:"location"`
+	Status   int    `json:"status,omitempty" yaml:"status,omitempty"` // A 3xx code; 302 Found if zero
+}
+
+// Parse parses a rule set in YAML or JSON. Unknown fields are errors, so
+// that misspelled conditions do not silently match everything.
+func Parse(data []byte) (*RuleSet, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var rs RuleSet
+	if err := dec.Decode(&rs); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+	}
+	return &rs, nil
+}
+
+// LoadFile reads and parses a rule set file in YAML or JSON.
+func LoadFile(name string) (*RuleSet, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Engine applies a compiled rule set and counts rule hits.
+type Engine struct {
+	request  []*compiledRule
+	response []*compiledRule
+	all      []*compiledRule // In rule set order
+}
+
+// RuleStats reports how many messages a rule has matched.
+type RuleStats struct {
+	Name string
+	Hits uint64
+}
+
+// Compile checks and compiles the rule set.
+func Compile(rs *RuleSet) (*Engine, error) {
+	e := &Engine{}
+	names := make(map[string]bool)
+	for _, rule := range rs.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("%w: rules need a name", ErrInvalidRule)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("%w: duplicate rule name %q", ErrInvalidRule, rule.Name)
+		}
+		names[rule.Name] = true
+		r, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("%w: rule %q: %v", ErrInvalidRule, rule.Name, err)
+		}
+		e.all = append(e.all, r)
+		if r.response {
+			e.response = append(e.response, r)
+		} else {
+			e.request = append(e.request, r)
+		}
+	}
+	return e, nil
+}
+
+// Config returns an inspector configuration whose callbacks apply the rules.
+func (e *Engine) Config() httpinspector.Config {
+	return httpinspector.Config{
+		OnRequest:  e.OnRequest,
+		OnResponse: e.OnResponse,
+	}
+}
+
+// OnRequest applies the request rules to req. Blocked and redirected
+// requests are answered with an *httpinspector.Reject.
+func (e *Engine) OnRequest(req *http.Request) error {
+	for _, r := range e.request {
+		m, ok := r.matchRequest(req)
+		if !ok {
+			continue
+		}
+		r.hits.Add(1)
+		for _, a := range r.actions {
+			if err := a.applyRequest(req, r.pathRegex, m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// OnResponse applies the response rules to resp.
+func (e *Engine) OnResponse(resp *http.Response) error {
+	for _, r := range e.response {
+		if !r.matchResponse(resp) {
+			continue
+		}
+		r.hits.Add(1)
+		for _, a := range r.actions {
+			a.applyHeader(resp.Header)
+		}
+	}
+	return nil
+}
+
+// Stats returns the hit counters of every rule, in rule set order.
+func (e *Engine) Stats() []RuleStats {
+	stats := make([]RuleStats, len(e.all))
+	for i, r := range e.all {
+		stats[i] = RuleStats{Name: r.name, Hits: r.hits.Load()}
+	}
+	return stats
+}
+
+type compiledRule struct {
+	name      string
+	response  bool
+	methods   []string
+	host      *regexp.Regexp
+	path      *regexp.Regexp
+	pathRegex *regexp.Regexp
+	headers   []headerMatcher
+	status    map[int]bool
+	actions   []Action
+	hits      atomic.Uint64
+}
+
+type headerMatcher struct {
+	name  string
+	value *regexp.Regexp
+}
+
+func compileRule(rule Rule) (*compiledRule, error) {
+	r := &compiledRule{name: rule.Name, methods: rule.Match.Method}
+	switch rule.Phase {
+	case "", PhaseRequest:
+	case PhaseResponse:
+		r.response = true
+	default:
+		return nil, fmt.Errorf("unknown phase %q", rule.Phase)
+	}
+	m := rule.Match
+	if m.Host != "" {
+		r.host = compileGlob(strings.ToLower(m.Host))
+	}
+	if m.Path != "" {
+		r.path = compileGlob(m.Path)
+	}
+	if m.PathRegex != "" {
+		re, err := regexp.Compile(m.PathRegex)
+		if err != nil {
+			return nil, err
+		}
+		r.pathRegex = re
+	}
+	for _, h := range m.Headers {
+		if h.Name == "" {
+			return nil, errors.New("header matches need a name")
+		}
+		hm := headerMatcher{name: h.Name}
+		switch {
+		case h.Value != "" && h.Regex != "":
+			return nil, fmt.Errorf("header %q has both a value and a regex", h.Name)
+		case h.Value != "":
+			hm.value = compileGlob(h.Value)
+		case h.Regex != "":
+			re, err := regexp.Compile(h.Regex)
+			if err != nil {
+				return nil, err
+			}
+			hm.value = re
+		}
+		r.headers = append(r.headers, hm)
+	}
+	if len(m.Status) > 0 {
+		if !r.response {
+			return nil, errors.New("status can only be matched by response rules")
+		}
+		r.status = make(map[int]bool)
+		for _, code := range m.Status {
+			r.status[code] = true
+		}
+	}
+	if len(rule.Actions) == 0 {
+		return nil, errors.New("no actions")
+	}
+	for _, a := range rule.Actions {
+		if err := a.check(r.response); err != nil {
+			return nil, err
+		}
+	}
+	r.actions = rule.Actions
+	return r, nil
+}
+
+// compileGlob compiles a glob in which * matches any run of characters,
+// including slashes, and ? matches any one character.
+func compileGlob(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, c := range glob {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// matchRequest reports whether req matches, along with the submatches of
+// the path regexp.
+func (r *compiledRule) matchRequest(req *http.Request) (pathMatch []int, ok bool) {
+	if !r.matchTarget(req) || !matchHeaders(r.headers, req.Header) {
+		return nil, false
+	}
+	if r.pathRegex != nil {
+		pathMatch = r.pathRegex.FindStringSubmatchIndex(req.URL.Path)
+	}
+	return pathMatch, true
+}
+
+func (r *compiledRule) matchResponse(resp *http.Response) bool {
+	if r.status != nil && !r.status[resp.StatusCode] {
+		return false
+	}
+	if r.methods != nil || r.host != nil || r.path != nil || r.pathRegex != nil {
+		if resp.Request == nil || !r.matchTarget(resp.Request) {
+			return false
+		}
+	}
+	return matchHeaders(r.headers, resp.Header)
+}
+
+// matchTarget checks the method, host and path conditions against req.
+func (r *compiledRule) matchTarget(req *http.Request) bool {
+	if r.methods != nil {
+		found := false
+		for _, m := range r.methods {
+			found = found || strings.EqualFold(m, req.Method)
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.host != nil && !r.host.MatchString(strings.ToLower(hostname(req))) {
+		return false
+	}
+	if r.path != nil && !r.path.MatchString(req.URL.Path) {
+		return false
+	}
+	return r.pathRegex == nil || r.pathRegex.MatchString(req.URL.Path)
+}
+
+func matchHeaders(matchers []headerMatcher, header http.Header) bool {
+	for _, hm := range matchers {
+		values := header.Values(hm.name)
+		if len(values) == 0 {
+			return false
+		}
+		if hm.value == nil {
+			continue
+		}
+		found := false
+		for _, v := range values {
+			found = found || hm.value.MatchString(v)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// hostname returns the host req is addressed to, without a port.
+func hostname(req *http.Request) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	return strings.Trim(host, "[]")
+}
+
+// check verifies that exactly one change is set, and that it applies to the
+// rule's phase.
+func (a Action) check(response bool) error {
+	set := 0
+	for _, ok := range []bool{
+		a.SetHeader != nil, a.AppendHeader != nil, a.RemoveHeader != nil,
+		a.RewritePath != "", a.Block != 0, a.Redirect != nil,
+	} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("each action must set exactly one change")
+	}
+	if response && (a.RewritePath != "" || a.Block != 0 || a.Redirect != nil) {
+		return errors.New("response rules can only change headers")
+	}
+	if a.Block != 0 && (a.Block < 400 || a.Block > 599) {
+		return fmt.Errorf("bad block status %d: blocks need a 4xx or 5xx status", a.Block)
+	}
+	if a.Redirect != nil && a.Redirect.Location == "" {
+		return errors.New("redirects need a location")
+	}
+	if a.Redirect != nil && a.Redirect.Status != 0 && (a.Redirect.Status < 300 || a.Redirect.Status > 399) {
+		return fmt.Errorf("bad redirect status %d: redirects need a 3xx status", a.Redirect.Status)
+	}
+	return nil
+}
+
+// applyRequest applies the action to req. pathMatch holds the submatches of
+// the rule's path regexp re, if it has one.
+func (a Action) applyRequest(req *http.Request, re *regexp.Regexp, pathMatch []int) error {
+	switch {
+	case a.Block != 0:
+		return &httpinspector.Reject{Status: a.Block}
+	case a.Redirect != nil:
+		status := a.Redirect.Status
+		if status == 0 {
+			status = http.StatusFound
+		}
+		location := a.Redirect.Location
+		if pathMatch != nil {
+			location = string(re.ExpandString(nil, location, req.URL.Path, pathMatch))
+		}
+		return &httpinspector.Reject{
+			Status:  status,
+			Headers: http.Header{"Location": {location}},
+		}
+	case a.RewritePath != "":
+		if pathMatch != nil {
+			path := req.URL.Path
+			replaced := re.ExpandString(nil, a.RewritePath, path, pathMatch)
+			req.URL.Path = path[:pathMatch[0]] + string(replaced) + path[pathMatch[1]:]
+		} else {
+			req.URL.Path = a.RewritePath
+		}
+		req.URL.RawPath = ""
+	default:
+		a.applyHeader(req.Header)
+	}
+	return nil
+}
+
+func (a Action) applyHeader(header http.Header) {
+	for name, value := range a.SetHeader {
+		header.Set(name, value)
+	}
+	for name, value := range a.AppendHeader {
+		header.Add(name, value)
+	}
+	for _, name := range a.RemoveHeader {
+		header.Del(name)
+	}
+}
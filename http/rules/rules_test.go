@@ -0,0 +1,181 @@
+package rules
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	httpinspector "github.com/go-i2p/go-connfilter/http"
+)
+
+const testRules = `
+rules:
+  - name: block-admin
+    match:
+      method: [POST]
+      host: "*.example.com"
+      path: "/admin/*"
+    actions:
+      - block: 451
+  - name: redirect-old
+    match:
+      path_regex: "^/old/(.*)$"
+    actions:
+      - redirect: {location: "/new/$1", status: 301}
+  - name: api-v2
+    match:
+      path_regex: "^/api/v1/"
+      headers:
+        - name: X-Client
+          value: "beta-*"
+    actions:
+      - rewrite_path: "/api/v2/"
+      - set_header: {X-Rewritten: "yes"}
+      - remove_header: [X-Client]
+  - name: hsts
+    phase: response
+    match:
+      status: [200]
+      host: "www.example.com"
+    actions:
+      - append_header: {Strict-Transport-Security: "max-age=60"}
+`
+
+func TestEngine(t *testing.T) {
+	rs, err := Parse([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine, err := Compile(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		header   http.Header
+		status   int    // Status of the Reject, if any
+		location string // Location of the Reject
+		path     string // Path after the rules ran
+	}{
+		{name: "blocked", method: "POST", url: "http://a.example.com:8080/admin/users", status: 451},
+		{name: "other method", method: "GET", url: "http://a.example.com/admin/users", path: "/admin/users"},
+		{name: "other host", method: "POST", url: "http://example.org/admin/users", path: "/admin/users"},
+		{name: "redirect", method: "GET", url: "http://example.com/old/a/b", status: 301, location: "/new/a/b"},
+		{
+			name: "rewrite", method: "GET", url: "http://example.com/api/v1/items",
+			header: http.Header{"X-Client": {"beta-7"}}, path: "/api/v2/items",
+		},
+		{
+			name: "header mismatch", method: "GET", url: "http://example.com/api/v1/items",
+			header: http.Header{"X-Client": {"stable"}}, path: "/api/v1/items",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			err := engine.OnRequest(req)
+			var reject *httpinspector.Reject
+			if tt.status != 0 {
+				if !errors.As(err, &reject) || reject.Status != tt.status {
+					t.Fatalf("got %v, want status %d", err, tt.status)
+				}
+				if got := reject.Headers.Get("Location"); got != tt.location {
+					t.Errorf("got location %q, want %q", got, tt.location)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.URL.Path != tt.path {
+				t.Errorf("got path %q, want %q", req.URL.Path, tt.path)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/api/v1/x", nil)
+	req.Header.Set("X-Client", "beta-1")
+	engine.OnRequest(req)
+	if req.Header.Get("X-Rewritten") != "yes" || req.Header.Get("X-Client") != "" {
+		t.Errorf("headers not rewritten: %v", req.Header)
+	}
+
+	for _, status := range []int{200, 404} {
+		resp := &http.Response{
+			StatusCode: status,
+			Header:     http.Header{"Strict-Transport-Security": {"old"}},
+			Request:    httptest.NewRequest("GET", "http://www.example.com/", nil),
+		}
+		engine.OnResponse(resp)
+		want := 1
+		if status == 200 {
+			want = 2
+		}
+		if got := len(resp.Header.Values("Strict-Transport-Security")); got != want {
+			t.Errorf("status %d: got %d values, want %d", status, got, want)
+		}
+	}
+
+	want := map[string]uint64{"block-admin": 1, "redirect-old": 1, "api-v2": 2, "hsts": 1}
+	for _, s := range engine.Stats() {
+		if s.Hits != want[s.Name] {
+			t.Errorf("rule %q: got %d hits, want %d", s.Name, s.Hits, want[s.Name])
+		}
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	rs, err := Parse([]byte(`{"rules": [{"name": "strip", "match": {"headers": [{"name": "Cookie"}]},
+		"actions": [{"remove_header": ["Cookie"]}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine, err := Compile(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Cookie", "a=b")
+	engine.OnRequest(req)
+	if req.Header.Get("Cookie") != "" {
+		t.Error("cookie not removed")
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	for name, src := range map[string]string{
+		"unknown field":   `rules: [{name: a, match: {paht: /}, actions: [{block: 403}]}]`,
+		"no name":         `rules: [{actions: [{block: 403}]}]`,
+		"duplicate name":  `rules: [{name: a, actions: [{block: 403}]}, {name: a, actions: [{block: 403}]}]`,
+		"no actions":      `rules: [{name: a}]`,
+		"two changes":     `rules: [{name: a, actions: [{block: 403, rewrite_path: /}]}]`,
+		"response block":  `rules: [{name: a, phase: response, actions: [{block: 403}]}]`,
+		"request status":  `rules: [{name: a, match: {status: [200]}, actions: [{block: 403}]}]`,
+		"bad regex":       `rules: [{name: a, match: {path_regex: "("}, actions: [{block: 403}]}]`,
+		"unknown phase":   `rules: [{name: a, phase: later, actions: [{block: 403}]}]`,
+		"bad block":       `rules: [{name: a, actions: [{block: 42}]}]`,
+		"interim block":   `rules: [{name: a, actions: [{block: 101}]}]`,
+		"no content":      `rules: [{name: a, actions: [{block: 204}]}]`,
+		"not modified":    `rules: [{name: a, actions: [{block: 304}]}]`,
+		"block status":    `rules: [{name: a, actions: [{block: 600}]}]`,
+		"ok redirect":     `rules: [{name: a, actions: [{redirect: {location: /, status: 200}}]}]`,
+		"bad redirect":    `rules: [{name: a, actions: [{redirect: {location: /, status: 404}}]}]`,
+		"empty redirect":  `rules: [{name: a, actions: [{redirect: {status: 301}}]}]`,
+		"nameless header": `rules: [{name: a, match: {headers: [{value: x}]}, actions: [{block: 403}]}]`,
+	} {
+		rs, err := Parse([]byte(src))
+		if err == nil {
+			_, err = Compile(rs)
+		}
+		if !errors.Is(err, ErrInvalidRule) {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package httpinspector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+)
+
+// standardMethods are the methods defined by RFC 9110, and PATCH (RFC 5789).
+var standardMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodDelete,
+	http.MethodConnect,
+	http.MethodOptions,
+	http.MethodTrace,
+	http.MethodPatch,
+}
+
+// WebDAVMethods are the extension methods of WebDAV (RFC 4918) and its
+// versioning extensions, for use in Config.ExtensionMethods.
+var WebDAVMethods = []string{
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+	"REPORT", "SEARCH", "MKCALENDAR", "ACL", "BIND", "UNBIND", "REBIND",
+	"VERSION-CONTROL", "CHECKOUT", "UNCHECKOUT", "CHECKIN", "UPDATE",
+	"LABEL", "MERGE", "MKWORKSPACE", "MKACTIVITY", "BASELINE-CONTROL",
+	"ORDERPATCH",
+}
+
+// methodSet holds the methods a connection recognizes in request lines.
+type methodSet struct {
+	methods map[string]bool
+	maxLen  int
+}
+
+func newMethodSet(extensions []string) methodSet {
+	m := methodSet{methods: make(map[string]bool)}
+	for _, lists := range [][]string{standardMethods, extensions} {
+		for _, method := range lists {
+			m.methods[method] = true
+			m.maxLen = max(m.maxLen, len(method))
+		}
+	}
+	return m
+}
+
+// sniffRequest reports whether b starts with a valid HTTP/1.x request line:
+// a recognized method, a request-target and an HTTP/1.x version, separated
+// by single spaces. ok is false when more bytes are needed to tell.
+func (m methodSet) sniffRequest(b []byte, eof bool) (isHTTP, ok bool) {
+	sp := bytes.IndexByte(b, ' ')
+	if sp < 0 {
+		if eof || len(b) > m.maxLen {
+			return false, true
+		}
+		for method := range m.methods {
+			if len(method) >= len(b) && method[:len(b)] == string(b) {
+				return false, false
+			}
+		}
+		return false, true
+	}
+	if !m.methods[string(b[:sp])] {
+		return false, true
+	}
+
+	end := bytes.IndexByte(b, '\n')
+	if end < 0 {
+		if eof || len(b) > http.DefaultMaxHeaderBytes {
+			return false, true
+		}
+		return false, false
+	}
+	line := bytes.TrimSuffix(b[sp+1:end], []byte("\r"))
+	sp = bytes.LastIndexByte(line, ' ')
+	if sp <= 0 || !isHTTP1Version(line[sp+1:]) {
+		return false, true
+	}
+	for _, c := range line[:sp] {
+		if c <= ' ' || c == 0x7f {
+			return false, true
+		}
+	}
+	return true, true
+}
+
+// sniffResponse reports whether b starts with an HTTP/1.x status line: the
+// version and a three-digit status code. ok is false when more bytes are
+// needed to tell.
+func sniffResponse(b []byte, eof bool) (isHTTP, ok bool) {
+	const pattern = "HTTP/1.# ###" // # stands for a digit
+	for i := 0; i < len(pattern); i++ {
+		if i == len(b) {
+			return false, eof
+		}
+		if pattern[i] == '#' && (b[i] < '0' || b[i] > '9') ||
+			pattern[i] != '#' && b[i] != pattern[i] {
+			return false, true
+		}
+	}
+	return true, true
+}
+
+// sniffHTTP2Client reports whether b starts with the HTTP/2 client
+// connection preface. ok is false when more bytes are needed to tell.
+func sniffHTTP2Client(b []byte, eof bool) (isHTTP2, ok bool) {
+	if len(b) < len(http2Preface) {
+		return false, eof || !bytes.HasPrefix([]byte(http2Preface), b)
+	}
+	return string(b[:len(http2Preface)]) == http2Preface, true
+}
+
+// sniffHTTP2Server reports whether b starts with the SETTINGS frame that
+// makes up the HTTP/2 server connection preface, which a server may send
+// before reading the client's. ok is false when more bytes are needed to
+// tell.
+func sniffHTTP2Server(b []byte, eof bool) (isHTTP2, ok bool) {
+	if len(b) < h2FrameHeaderLen {
+		return false, eof || b[0] != 0
+	}
+	length := int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	return b[3] == h2FrameSettings && b[4] == 0 && length%6 == 0 &&
+		binary.BigEndian.Uint32(b[5:]) == 0, true
+}
+
+// isHTTP1Version reports whether v is an HTTP/1.x version token.
+func isHTTP1Version(v []byte) bool {
+	return len(v) == len("HTTP/1.1") && bytes.HasPrefix(v, []byte("HTTP/1.")) &&
+		v[7] >= '0' && v[7] <= '9'
+}
@@ -0,0 +1,112 @@
+package httpinspector
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestSniffRequest(t *testing.T) {
+	methods := newMethodSet([]string{"PROPFIND"})
+	tests := []struct {
+		in     string
+		eof    bool
+		isHTTP bool
+		ok     bool
+	}{
+		{in: "GET / HTTP/1.1\r\n", isHTTP: true, ok: true},
+		{in: "CONNECT example.com:443 HTTP/1.1\r\n", isHTTP: true, ok: true},
+		{in: "TRACE * HTTP/1.0\n", isHTTP: true, ok: true},
+		{in: "PROPFIND /dav/ HTTP/1.1\r\n", isHTTP: true, ok: true},
+		{in: "MKCOL /dav/ HTTP/1.1\r\n", isHTTP: false, ok: true},
+		{in: "GETX / HTTP/1.1\r\n", isHTTP: false, ok: true},
+		{in: "get / HTTP/1.1\r\n", isHTTP: false, ok: true},
+		{in: "GET / HTTP/2.0\r\n", isHTTP: false, ok: true},
+		{in: "GET / SMTP/1.1\r\n", isHTTP: false, ok: true},
+		{in: "GET  HTTP/1.1\r\n", isHTTP: false, ok: true},
+		{in: "GET /a b HTTP/1.1\r\n", isHTTP: false, ok: true},
+		{in: "PRI * HTTP/2.0\r\n", isHTTP: false, ok: true},
+		{in: "\x16\x03\x01\x02\x00", isHTTP: false, ok: true},
+		{in: "PROP", ok: false},
+		{in: "GET / HTTP/1.1", ok: false},
+		{in: "GET / HTTP/1.1", eof: true, isHTTP: false, ok: true},
+		{in: "CONNEC", eof: true, isHTTP: false, ok: true},
+	}
+	for _, tt := range tests {
+		isHTTP, ok := methods.sniffRequest([]byte(tt.in), tt.eof)
+		if isHTTP != tt.isHTTP || ok != tt.ok {
+			t.Errorf("%q: got %v, %v; want %v, %v", tt.in, isHTTP, ok, tt.isHTTP, tt.ok)
+		}
+	}
+}
+
+func TestSniffResponse(t *testing.T) {
+	tests := []struct {
+		in     string
+		isHTTP bool
+		ok     bool
+	}{
+		{in: "HTTP/1.1 200 OK\r\n", isHTTP: true, ok: true},
+		{in: "HTTP/1.0 404", isHTTP: true, ok: true},
+		{in: "HTTP/1.1 2", ok: false},
+		{in: "HTTP/2 200 OK\r\n", isHTTP: false, ok: true},
+		{in: "HTTP/1.1 OK\r\n", isHTTP: false, ok: true},
+		{in: "SSH-2.0-OpenSSH", isHTTP: false, ok: true},
+	}
+	for _, tt := range tests {
+		isHTTP, ok := sniffResponse([]byte(tt.in), false)
+		if isHTTP != tt.isHTTP || ok != tt.ok {
+			t.Errorf("%q: got %v, %v; want %v, %v", tt.in, isHTTP, ok, tt.isHTTP, tt.ok)
+		}
+	}
+}
+
+func TestInspectorNonHTTP(t *testing.T) {
+	const sshBanner = "SSH-2.0-OpenSSH_9.6\r\n"
+
+	t.Run("Pass", func(t *testing.T) {
+		var prefix string
+		config := Config{OnNonHTTP: func(conn net.Conn, b []byte) NonHTTPAction {
+			prefix = string(b)
+			return NonHTTPPass
+		}}
+		conn := newInspectedConn(&mockConn{readData: []byte(sshBanner)}, config, false)
+		out, err := io.ReadAll(conn)
+		if err != nil || string(out) != sshBanner {
+			t.Fatalf("got %q, %v", out, err)
+		}
+		if prefix == "" {
+			t.Error("OnNonHTTP not called")
+		}
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		config := Config{OnNonHTTP: func(net.Conn, []byte) NonHTTPAction { return NonHTTPDrop }}
+		conn := newInspectedConn(&mockConn{readData: []byte(sshBanner)}, config, false)
+		out, err := io.ReadAll(conn)
+		if !errors.Is(err, ErrNonHTTP) || len(out) != 0 {
+			t.Fatalf("got %q, %v", out, err)
+		}
+	})
+
+	t.Run("ExtensionMethod", func(t *testing.T) {
+		var seen []string
+		config := DefaultConfig()
+		config.OnRequest = func(req *http.Request) error {
+			seen = append(seen, req.Method)
+			return nil
+		}
+		config.OnNonHTTP = func(net.Conn, []byte) NonHTTPAction { return NonHTTPDrop }
+		in := "PROPFIND /dav/ HTTP/1.1\r\nHost: example.com\r\nDepth: 1\r\n\r\n" +
+			"TRACE / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+		conn := newInspectedConn(&mockConn{readData: []byte(in)}, config, false)
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Fatal(err)
+		}
+		if len(seen) != 2 || seen[0] != "PROPFIND" || seen[1] != "TRACE" {
+			t.Errorf("inspected %v", seen)
+		}
+	})
+}
@@ -0,0 +1,692 @@
+package httpinspector
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// streamState is the position of a messageStream within the byte stream.
+type streamState int
+
+const (
+	stateHead        streamState = iota // Expecting the header block of a message
+	stateBody                           // Inside the body of a message
+	statePassthrough                    // No longer HTTP; bytes are forwarded as they are
+	stateClosed                         // The connection is closing; bytes are dropped
+	stateWait                           // Held until a pending protocol switch is settled
+	stateTunnel                         // Taken over by a tunnel; bytes are left for it
+	stateHTTP2                          // Carrying HTTP/2 frames
+)
+
+// messageStream parses the HTTP/1.x messages flowing in one direction of a
+// connection, passes each to its callback and serializes the result. Bytes
+// are pushed in as they are read or written, so a message split across many
+// reads or writes is handled exactly like one that arrives whole, and every
+// message on a keep-alive connection is inspected in turn.
+type messageStream struct {
+	conn     *inspectedConn
+	requests bool // The stream carries requests rather than responses
+	buf      []byte
+	state    streamState
+	body     bodyFramer
+	err      error
+
+	// The message whose body is being buffered before its callback runs, or
+	// whose transformed body is being held until its length is known.
+	req       *http.Request
+	resp      *http.Response
+	origURL   string
+	buffering bool
+	bodyBuf   []byte
+
+	pump    *bodyPump    // The transformer of the body being streamed, if any
+	probe   *decodeProbe // The start of a body held until it is known to decode
+	discard bool         // The body belongs to a rejected request and is dropped
+	wait    bool         // The message may switch protocols; hold what follows it
+
+	h2 *http2Stream // The frames of an HTTP/2 connection
+}
+
+// feed processes the next bytes of the stream and returns the rewritten
+// output they complete. eof marks the end of the stream. Errors are sticky.
+func (s *messageStream) feed(in []byte, eof bool) ([]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.buf = append(s.buf, in...)
+	var out []byte
+	out, s.err = s.process(out, eof)
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+	return out, s.err
+}
+
+// take removes and returns the unprocessed bytes, which a tunnel takes over.
+func (s *messageStream) take() []byte {
+	b := s.buf
+	s.buf = nil
+	return b
+}
+
+// idle reports whether the stream is between messages.
+func (s *messageStream) idle() bool {
+	return s.state == stateHead && len(s.buf) == 0
+}
+
+func (s *messageStream) process(out []byte, eof bool) ([]byte, error) {
+	for {
+		switch s.state {
+		case statePassthrough:
+			out = append(out, s.buf...)
+			s.buf = s.buf[:0]
+			return out, nil
+
+		case stateClosed:
+			s.buf = s.buf[:0]
+			return out, nil
+
+		case stateTunnel:
+			return out, nil
+
+		case stateHTTP2:
+			b, err := s.h2.feed(s.buf)
+			s.buf = s.buf[:0]
+			return append(out, b...), err
+
+		case stateWait:
+			if !s.endSwitch() {
+				return out, nil
+			}
+
+		case stateHead:
+			if !s.requests {
+				if s.followHTTP2() {
+					continue
+				}
+				if out = s.appendRejections(out); s.state == stateClosed {
+					continue
+				}
+			}
+			if len(s.buf) == 0 {
+				return out, nil
+			}
+			if !s.conn.config.DisableHTTP2 {
+				isHTTP2, ok := s.sniffHTTP2(eof)
+				if !ok {
+					return out, nil
+				}
+				if isHTTP2 {
+					s.startHTTP2()
+					continue
+				}
+			}
+			isHTTP, ok := s.sniff(eof)
+			if !ok {
+				return out, nil
+			}
+			if !isHTTP {
+				if err := s.nonHTTP(); err != nil {
+					return out, err
+				}
+				continue
+			}
+			end := headEnd(s.buf)
+			if end < 0 {
+				if len(s.buf) > http.DefaultMaxHeaderBytes {
+					return out, fmt.Errorf("%w: header block too large", ErrMalformedHTTP)
+				}
+				if eof {
+					s.state = statePassthrough
+					continue
+				}
+				return out, nil
+			}
+			head := s.buf[:end]
+			s.buf = s.buf[end:]
+			var err error
+			if s.requests {
+				out, err = s.startRequest(out, head)
+			} else {
+				out, err = s.startResponse(out, head)
+			}
+			if err != nil {
+				return out, err
+			}
+
+		case stateBody:
+			n, data, done, err := s.body.advance(s.buf, eof)
+			if err != nil {
+				return out, err
+			}
+			switch {
+			case s.discard:
+			case s.buffering:
+				if int64(len(s.bodyBuf)+len(data)) > s.conn.config.maxBufferedBodySize() {
+					return out, s.bodyTooLarge()
+				}
+				s.bodyBuf = append(s.bodyBuf, data...)
+			case s.probe != nil:
+				s.probe.raw = append(s.probe.raw, s.buf[:n]...)
+				s.probe.data = append(s.probe.data, data...)
+				if out, err = s.settleProbe(out, done); err != nil {
+					return out, err
+				}
+			case s.pump != nil:
+				if len(data) > 0 {
+					b, err := s.pump.feed(data, false)
+					if err != nil {
+						return out, fmt.Errorf("%w: %v", ErrInvalidModification, err)
+					}
+					out = s.appendTransformed(out, b)
+				}
+			default:
+				out = append(out, s.buf[:n]...)
+			}
+			s.buf = s.buf[n:]
+			if done {
+				if out, err = s.endMessage(out); err != nil {
+					return out, err
+				}
+				continue
+			}
+			if n == 0 {
+				if eof {
+					// The stream ended inside a body. Whatever is left is
+					// passed on, except a buffered body whose message was
+					// never emitted.
+					s.req, s.resp, s.buffering, s.bodyBuf = nil, nil, false, nil
+					if p := s.probe; p != nil {
+						s.probe = nil
+						out = append(s.appendHead(out, p.req, p.resp, p.framing, p.length), p.raw...)
+					}
+					if s.pump != nil {
+						s.pump.abort()
+						s.conn.removePump(s.pump)
+						s.pump = nil
+					}
+					s.state = statePassthrough
+					continue
+				}
+				return out, nil
+			}
+		}
+	}
+}
+
+// sniff reports whether the buffered bytes start an HTTP message. ok is
+// false when more bytes are needed to tell.
+func (s *messageStream) sniff(eof bool) (isHTTP, ok bool) {
+	if s.requests {
+		return s.conn.methods.sniffRequest(s.buf, eof)
+	}
+	return sniffResponse(s.buf, eof)
+}
+
+// sniffHTTP2 reports whether the buffered bytes start an HTTP/2 connection.
+// ok is false when more bytes are needed to tell.
+func (s *messageStream) sniffHTTP2(eof bool) (isHTTP2, ok bool) {
+	if s.requests {
+		return sniffHTTP2Client(s.buf, eof)
+	}
+	return sniffHTTP2Server(s.buf, eof)
+}
+
+// nonHTTP handles traffic that is not HTTP as OnNonHTTP decides: it is
+// either passed through or the connection is closed.
+func (s *messageStream) nonHTTP() error {
+	action := NonHTTPPass
+	if s.conn.config.OnNonHTTP != nil {
+		action = s.conn.config.OnNonHTTP(s.conn.Conn, s.buf)
+	}
+	if action == NonHTTPDrop {
+		s.state = stateClosed
+		s.buf = s.buf[:0]
+		s.conn.Conn.Close()
+		return ErrNonHTTP
+	}
+	s.state = statePassthrough
+	return nil
+}
+
+// startRequest parses a request header block and either runs OnRequest and
+// emits the header, or starts buffering the body if the callback needs it.
+func (s *messageStream) startRequest(out, head []byte) ([]byte, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return out, fmt.Errorf("%w: %v", ErrMalformedHTTP, err)
+	}
+	req = s.conn.newExchange(req, 0)
+	s.conn.pushRequest(req)
+	f := requestFraming(req)
+	s.body = bodyFramer{framing: f, remaining: req.ContentLength}
+	s.state = stateBody
+	s.origURL = req.URL.String()
+
+	if s.conn.config.BufferRequestBody && f != frameNone {
+		s.req = req
+		s.buffering = true
+		return out, nil
+	}
+
+	length := req.ContentLength
+	req.Body = http.NoBody
+	if rejected, err := s.onRequest(req, f != frameNone); rejected || err != nil {
+		return out, err
+	}
+	if rejected, err := s.startSwitch(req, f != frameNone); rejected || err != nil {
+		return out, err
+	}
+	return s.startBody(out, req, nil, f, length), nil
+}
+
+// startResponse parses a response header block and either runs OnResponse
+// and emits the header, or starts buffering the body if the callback needs
+// it.
+func (s *messageStream) startResponse(out, head []byte) ([]byte, error) {
+	req := s.conn.nextRequest(false)
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), req)
+	if err != nil {
+		return out, fmt.Errorf("%w: %v", ErrMalformedHTTP, err)
+	}
+	interim := resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols
+	if !interim {
+		s.conn.nextRequest(true)
+		responseStarted(req)
+	}
+	method := http.MethodGet
+	if req != nil {
+		method = req.Method
+	}
+	f := responseFraming(resp, method)
+	s.body = bodyFramer{framing: f, remaining: resp.ContentLength}
+	s.state = stateBody
+
+	if s.conn.config.BufferResponseBody && f != frameNone {
+		s.resp = resp
+		s.buffering = true
+		if !interim {
+			// Responses that switch protocols have no body.
+			s.conn.switchProtocols(req, resp, false, nil)
+		}
+		return out, nil
+	}
+
+	length := resp.ContentLength
+	resp.Body = http.NoBody
+	if !interim {
+		if err := s.onResponse(resp); err != nil {
+			return out, err
+		}
+	}
+	if !interim {
+		// The connection no longer carries HTTP after a successful CONNECT
+		// or protocol upgrade.
+		switched := resp.StatusCode == http.StatusSwitchingProtocols ||
+			method == http.MethodConnect && resp.StatusCode >= 200 && resp.StatusCode < 300
+		switch {
+		case s.conn.switchProtocols(req, resp, switched, s.tunnelCallback(req, resp)):
+			s.state = stateTunnel
+		case switched:
+			s.state = statePassthrough
+		}
+	}
+	return s.startBody(out, nil, resp, f, length), nil
+}
+
+// startBody emits the head of req or resp, whose body has framing f and the
+// given length, once the transformer of the body, if any, is started. A body
+// the transformer is to read decoded is held in a probe until it is known to
+// decode.
+func (s *messageStream) startBody(out []byte, req *http.Request, resp *http.Response, f framing, length int64) []byte {
+	if f != frameNone {
+		if coding, ok := s.decodesBody(req, resp); ok {
+			s.probe = &decodeProbe{req: req, resp: resp, coding: coding, framing: f, length: length}
+			return out
+		}
+	}
+	return s.emitHead(out, req, resp, f, length, false)
+}
+
+// emitHead starts the transformer of the body of req or resp, if any, and
+// emits its head. A transformed body is sent chunked, except to HTTP/1.0
+// peers, which have no chunked coding: the head then waits for the length of
+// the transformed body.
+func (s *messageStream) emitHead(out []byte, req *http.Request, resp *http.Response, f framing, length int64, decode bool) []byte {
+	if f != frameNone && s.transformBody(req, resp, decode, false) {
+		switch {
+		case req != nil && !req.ProtoAtLeast(1, 1):
+			s.req = req
+			return out
+		case resp != nil && (!resp.ProtoAtLeast(1, 1) || resp.Request != nil && !resp.Request.ProtoAtLeast(1, 1)):
+			s.resp = resp
+			return out
+		}
+		f = frameChunked
+	}
+	return s.appendHead(out, req, resp, f, length)
+}
+
+// appendHead serializes the head of req or resp.
+func (s *messageStream) appendHead(out []byte, req *http.Request, resp *http.Response, f framing, length int64) []byte {
+	var buf bytes.Buffer
+	if req != nil {
+		writeRequestHead(&buf, req, s.origURL, f, length)
+	} else {
+		writeResponseHead(&buf, resp, f, length)
+	}
+	return append(out, buf.Bytes()...)
+}
+
+// decodeProbe holds the start of a body its transformer is to read decoded,
+// and the message it belongs to, until the decoder accepts it. A body that
+// does not decode is then passed on as it is, without running the
+// transformer, since its head has not been committed to a transformed body
+// yet.
+type decodeProbe struct {
+	req     *http.Request
+	resp    *http.Response
+	coding  string
+	framing framing
+	length  int64
+	raw     []byte // The body as it arrived
+	data    []byte // The body without its transfer framing
+}
+
+// settleProbe emits the held message once enough of its body has arrived to
+// tell whether it decodes. complete tells whether the whole body has.
+func (s *messageStream) settleProbe(out []byte, complete bool) ([]byte, error) {
+	p := s.probe
+	ok, more := probeDecoder(p.coding, p.data, complete)
+	if more {
+		return out, nil
+	}
+	s.probe = nil
+	if !ok {
+		return append(s.appendHead(out, p.req, p.resp, p.framing, p.length), p.raw...), nil
+	}
+	out = s.emitHead(out, p.req, p.resp, p.framing, p.length, true)
+	if s.pump == nil {
+		return append(out, p.raw...), nil
+	}
+	if len(p.data) == 0 {
+		return out, nil
+	}
+	b, err := s.pump.feed(p.data, false)
+	if err != nil {
+		return out, fmt.Errorf("%w: %v", ErrInvalidModification, err)
+	}
+	return s.appendTransformed(out, b), nil
+}
+
+// decodesBody reports whether the body of req or resp is to be decoded for
+// its transformer, and returns its content coding.
+func (s *messageStream) decodesBody(req *http.Request, resp *http.Response) (string, bool) {
+	config := s.conn.config
+	if !config.DecodeContentEncoding || req != nil && config.OnRequestBody == nil || resp != nil && config.OnResponseBody == nil {
+		return "", false
+	}
+	return contentCoding(s.header(req, resp))
+}
+
+// endMessage finishes the current message once its body is complete. For a
+// buffered message it runs the callback and emits the rewritten message; a
+// transformed body is completed.
+func (s *messageStream) endMessage(out []byte) ([]byte, error) {
+	if s.state == stateBody {
+		s.state = stateHead
+		if s.wait {
+			s.state = stateWait
+		}
+	}
+	s.discard, s.wait = false, false
+	if s.pump != nil {
+		b, err := s.finishTransform(nil)
+		if err != nil {
+			return out, err
+		}
+		if s.req == nil && s.resp == nil {
+			out = appendChunk(out, b)
+			return append(out, lastChunk...), nil
+		}
+		req, resp, body := s.req, s.resp, append(s.bodyBuf, b...)
+		s.req, s.resp, s.bodyBuf = nil, nil, nil
+		return appendMessage(out, req, resp, s.origURL, body), nil
+	}
+	if !s.buffering {
+		return out, nil
+	}
+	req, resp := s.req, s.resp
+	body := s.bodyBuf
+	s.req, s.resp, s.buffering, s.bodyBuf = nil, nil, false, nil
+
+	header := s.header(req, resp)
+	_, decode := s.decodesBody(req, resp)
+	body, decoded := s.decodeContent(header, body)
+	var err error
+	if req != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		if rejected, err := s.onRequest(req, false); rejected || err != nil {
+			return out, err
+		}
+		if rejected, err := s.startSwitch(req, false); rejected || err != nil {
+			return out, err
+		}
+		if body, err = readBody(req.Body); err != nil {
+			return out, err
+		}
+	} else {
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		if err := s.onResponse(resp); err != nil {
+			return out, err
+		}
+		if body, err = readBody(resp.Body); err != nil {
+			return out, err
+		}
+	}
+	// A body the transformer should read decoded but that does not decode
+	// is passed on as it is.
+	if (decoded || !decode) && s.transformBody(req, resp, false, decoded) {
+		if body, err = s.finishTransform(body); err != nil {
+			return out, err
+		}
+	}
+	if decoded {
+		if body, err = encodeContent(header, body); err != nil {
+			return out, err
+		}
+	}
+	return appendMessage(out, req, resp, s.origURL, body), nil
+}
+
+// appendMessage serializes a request or response with a complete body.
+func appendMessage(out []byte, req *http.Request, resp *http.Response, origURL string, body []byte) []byte {
+	var buf bytes.Buffer
+	if req != nil {
+		req.TransferEncoding = nil
+		writeRequestHead(&buf, req, origURL, frameLength, int64(len(body)))
+	} else {
+		resp.TransferEncoding = nil
+		writeResponseHead(&buf, resp, frameLength, int64(len(body)))
+	}
+	out = append(out, buf.Bytes()...)
+	return append(out, body...)
+}
+
+// transformBody starts the body callback's transformer for req or resp. It
+// reports whether the body is to be transformed. If decode is set, the
+// transformer reads the body decoded and its output is encoded again, unless
+// DropContentEncoding is set; decoded tells that the body fed to it is
+// already decoded.
+func (s *messageStream) transformBody(req *http.Request, resp *http.Response, decode, decoded bool) bool {
+	config := s.conn.config
+	if req != nil && config.OnRequestBody == nil || resp != nil && config.OnResponseBody == nil {
+		return false
+	}
+	p := newBodyPump()
+	var in io.Reader = p.reader()
+	if decoded {
+		in = decodedReader{in}
+	}
+	var enc *encodingReader
+	header := s.header(req, resp)
+	dropped := header.Values("Content-Encoding")
+	if coding, ok := contentCoding(header); ok && decode {
+		in = &decodingReader{coding: coding, src: in, limit: config.maxDecodedBodySize()}
+		if config.DropContentEncoding {
+			header.Del("Content-Encoding")
+		} else {
+			var err error
+			if enc, err = newEncodingReader(coding, nil); err != nil {
+				return false
+			}
+		}
+	}
+	var r io.Reader
+	if req != nil {
+		r = config.OnRequestBody(req, in)
+	} else {
+		r = config.OnResponseBody(resp, in)
+	}
+	if r == nil {
+		if len(dropped) > 0 && header.Get("Content-Encoding") == "" {
+			// The body is passed on encoded after all.
+			header["Content-Encoding"] = dropped
+		}
+		return false
+	}
+	if enc != nil {
+		enc.src = r
+		r = enc
+	}
+	s.conn.addPump(p)
+	p.start(r)
+	s.pump = p
+	return true
+}
+
+// header returns the header of req, or else of resp.
+func (s *messageStream) header(req *http.Request, resp *http.Response) http.Header {
+	if req != nil {
+		return req.Header
+	}
+	return resp.Header
+}
+
+// finishTransform passes the last of the body to the transformer and returns
+// the rest of its output.
+func (s *messageStream) finishTransform(in []byte) ([]byte, error) {
+	p := s.pump
+	s.pump = nil
+	b, err := p.feed(in, true)
+	s.conn.removePump(p)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidModification, err)
+	}
+	return b, nil
+}
+
+// appendTransformed adds output of the body transformer to out, or holds it
+// if the message waits for the length of its body.
+func (s *messageStream) appendTransformed(out, b []byte) []byte {
+	if s.req != nil || s.resp != nil {
+		s.bodyBuf = append(s.bodyBuf, b...)
+		return out
+	}
+	return appendChunk(out, b)
+}
+
+// bodyTooLarge gives up a buffered message whose body outgrew
+// MaxBufferedBodySize. A request is answered with 413 Content Too Large and
+// the connection closed, since the rest of its body is still to come; a
+// response fails with ErrBodyTooLarge.
+func (s *messageStream) bodyTooLarge() error {
+	req, limit := s.req, s.conn.config.maxBufferedBodySize()
+	s.req, s.resp, s.buffering, s.bodyBuf = nil, nil, false, nil
+	if req == nil {
+		return fmt.Errorf("%w: buffered body exceeds %d bytes", ErrBodyTooLarge, limit)
+	}
+	s.rejectRequest(req, &Reject{Status: http.StatusRequestEntityTooLarge, Close: true}, true)
+	return nil
+}
+
+// readBody reads and closes a body left by a callback.
+func readBody(body io.ReadCloser) ([]byte, error) {
+	defer body.Close()
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidModification, err)
+	}
+	return b, nil
+}
+
+// onRequest runs OnRequest. A request the callback rejects is answered by
+// the inspector and reported by rejected; bodyPending tells whether its body
+// has yet to arrive, in which case the body is dropped as it does.
+func (s *messageStream) onRequest(req *http.Request, bodyPending bool) (rejected bool, err error) {
+	if s.conn.config.OnRequest == nil {
+		return false, nil
+	}
+	return s.checkReject(req, s.conn.config.OnRequest(req), bodyPending, "request modification failed")
+}
+
+// checkReject handles the error a callback returned for req. A *Reject is
+// answered by the inspector; other errors are wrapped with what.
+func (s *messageStream) checkReject(req *http.Request, err error, bodyPending bool, what string) (rejected bool, _ error) {
+	var reject *Reject
+	if errors.As(err, &reject) {
+		if err := reject.check(); err != nil {
+			return false, fmt.Errorf("%s: %w", what, err)
+		}
+		s.rejectRequest(req, reject, bodyPending)
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", what, err)
+	}
+	return false, nil
+}
+
+// rejectRequest answers req with the response described by reject. The
+// connection is closed afterwards if asked to, or if the request leaves it
+// in doubt: HTTP/1.0 and "Connection: close" requests, and bodies the client
+// waits for "100 Continue" before sending.
+func (s *messageStream) rejectRequest(req *http.Request, reject *Reject, bodyPending bool) {
+	close := reject.Close || req.Close || !req.ProtoAtLeast(1, 1) ||
+		bodyPending && strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+	s.conn.rejectRequest(req, reject.response(req, close), close)
+	if close {
+		s.state = stateClosed
+		s.buf = s.buf[:0]
+		return
+	}
+	s.discard = bodyPending
+}
+
+// appendRejections adds the responses to rejected requests that are due
+// before the next response.
+func (s *messageStream) appendRejections(out []byte) []byte {
+	b, close := s.conn.popRejections()
+	if close {
+		s.state = stateClosed
+		s.buf = s.buf[:0]
+	}
+	return append(out, b...)
+}
+
+func (s *messageStream) onResponse(resp *http.Response) error {
+	if s.conn.config.OnResponse == nil {
+		return nil
+	}
+	if err := s.conn.config.OnResponse(resp); err != nil {
+		return fmt.Errorf("response modification failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package httpinspector
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// switchState tracks a request that may take the connection over from
+// HTTP, such as CONNECT, until its response tells whether it did.
+type switchState int
+
+const (
+	switchNone     switchState = iota
+	switchPending              // Awaiting the response
+	switchDone                 // The connection no longer carries HTTP
+	switchDeclined             // The connection goes on carrying HTTP
+)
+
+// rawConn is the view of the underlying connection given to a tunnel
+// inspector. Bytes the HTTP inspector read past the end of the last HTTP
+// message are returned before any read from the connection.
+type rawConn struct {
+	net.Conn
+	mu     sync.Mutex
+	prefix []byte
+}
+
+func (r *rawConn) Read(b []byte) (int, error) {
+	r.mu.Lock()
+	if len(r.prefix) > 0 {
+		n := copy(b, r.prefix)
+		r.prefix = r.prefix[n:]
+		r.mu.Unlock()
+		return n, nil
+	}
+	r.mu.Unlock()
+	return r.Conn.Read(b)
+}
+
+// unread queues b to be read before the rest of the connection.
+func (r *rawConn) unread(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prefix = append(r.prefix, b...)
+}
+
+// startSwitch prepares for a request that may take the connection over
+// from HTTP: a CONNECT, or a request to upgrade the protocol, which
+// OnUpgrade may reject. What follows the request is held until the response
+// to it tells whether the connection switched.
+func (s *messageStream) startSwitch(req *http.Request, bodyPending bool) (rejected bool, err error) {
+	if req.Method != http.MethodConnect {
+		protocol := upgradeProtocol(req.Header)
+		if protocol == "" || !req.ProtoAtLeast(1, 1) {
+			return false, nil
+		}
+		if s.conn.config.OnUpgrade != nil {
+			err := s.conn.config.OnUpgrade(req, protocol)
+			if rejected, err := s.checkReject(req, err, bodyPending, "upgrade failed"); rejected || err != nil {
+				return rejected, err
+			}
+		}
+	}
+	if s.state == stateHead {
+		s.state = stateWait
+	} else {
+		s.wait = true
+	}
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	s.conn.switching = switchPending
+	s.conn.switchReq = req
+	return false, nil
+}
+
+// upgradeProtocol returns the first protocol a request asks to upgrade to,
+// or "" if it does not ask for an upgrade.
+func upgradeProtocol(h http.Header) string {
+	upgrade := false
+	for _, v := range h["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			upgrade = upgrade || strings.EqualFold(strings.TrimSpace(token), "upgrade")
+		}
+	}
+	if !upgrade {
+		return ""
+	}
+	protocol, _, _ := strings.Cut(h.Get("Upgrade"), ",")
+	return strings.TrimSpace(protocol)
+}
+
+// tunnelCallback returns the callback inspecting the connection if the
+// response to req switches it away from HTTP.
+func (s *messageStream) tunnelCallback(req *http.Request, resp *http.Response) TunnelCallback {
+	if req != nil && req.Method == http.MethodConnect {
+		return s.conn.config.OnTunnel
+	}
+	name, _, _ := strings.Cut(upgradeProtocol(resp.Header), "/")
+	if name == "" && req != nil {
+		name, _, _ = strings.Cut(upgradeProtocol(req.Header), "/")
+	}
+	for protocol, callback := range s.conn.config.UpgradeInspectors {
+		if strings.EqualFold(protocol, name) {
+			return callback
+		}
+	}
+	return nil
+}
+
+// switchProtocols settles a pending protocol switch once resp, the response
+// to req, has been seen. If the connection switched, the tunnel callback (if
+// any) takes it over, and tunnel reports whether it did. The stream
+// carrying requests, held back until now, is then released.
+func (c *inspectedConn) switchProtocols(req *http.Request, resp *http.Response, switched bool, callback TunnelCallback) (tunnel bool) {
+	c.mu.Lock()
+	pending := c.switching == switchPending && c.switchReq == req
+	c.mu.Unlock()
+	if !pending {
+		return false
+	}
+
+	// The stream carrying requests holds back until the switch is settled,
+	// so the callback runs before anything can reach the tunnel.
+	var raw *rawConn
+	var conn net.Conn
+	if switched && callback != nil {
+		raw = &rawConn{Conn: c.Conn}
+		conn = callback(resp, raw)
+	}
+	c.mu.Lock()
+	c.switching = switchDeclined
+	if switched {
+		c.switching = switchDone
+		if conn != nil {
+			c.raw, c.tunnel = raw, conn
+		}
+	}
+	c.switchReq = nil
+	tunnel = c.tunnel != nil
+	c.mu.Unlock()
+
+	if !c.client {
+		// Requests are read; interrupt a Read waiting for more of them.
+		c.wake()
+		return tunnel
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.writeThrough(nil)
+	return tunnel
+}
+
+// endSwitch moves a stream on from waiting for a protocol switch. It
+// reports false while the switch is still pending.
+func (s *messageStream) endSwitch() bool {
+	c := s.conn
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.switching {
+	case switchPending:
+		return false
+	case switchDone:
+		s.state = statePassthrough
+		if c.tunnel != nil {
+			s.state = stateTunnel
+		}
+	default:
+		s.state = stateHead
+	}
+	c.switching = switchNone
+	return true
+}
@@ -0,0 +1,280 @@
+package httpinspector
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// upperConn upper-cases everything read from it.
+type upperConn struct {
+	net.Conn
+}
+
+func (c upperConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	copy(b, bytes.ToUpper(b[:n]))
+	return n, err
+}
+
+// connectProxy is a minimal forward proxy handling CONNECT requests.
+func connectProxy(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		target, err := net.Dial("tcp", r.URL.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		go func() {
+			io.Copy(conn, target)
+			conn.Close()
+		}()
+		io.Copy(target, brw)
+		target.Close()
+	})
+}
+
+func TestInspectorConnect(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var connects []string
+	config := Config{
+		OnRequest: func(req *http.Request) error {
+			if req.Method == http.MethodConnect {
+				connects = append(connects, req.URL.Host)
+				if req.URL.Host == "blocked.example:443" {
+					return &Reject{Status: http.StatusForbidden}
+				}
+			}
+			return nil
+		},
+		OnTunnel: func(resp *http.Response, conn net.Conn) net.Conn {
+			return upperConn{conn}
+		},
+	}
+	server := &http.Server{Handler: connectProxy(t)}
+	go server.Serve(New(l, config))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	fmt.Fprintf(conn, "CONNECT blocked.example:443 HTTP/1.1\r\nHost: blocked.example:443\r\n\r\n")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("denied CONNECT got %s", resp.Status)
+	}
+
+	// The tunneled bytes are sent along with the request, before the proxy
+	// has answered it, and must not be taken for HTTP.
+	target := echo.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nhello ", target, target)
+	resp, err = http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT got %s", resp.Status)
+	}
+	io.WriteString(conn, "world\n")
+	line, err := br.ReadString('\n')
+	if err != nil || line != "HELLO WORLD\n" {
+		t.Errorf("tunnel echoed %q, %v", line, err)
+	}
+	if len(connects) != 2 || connects[1] != target {
+		t.Errorf("OnRequest saw CONNECT to %v", connects)
+	}
+}
+
+func TestInspectorConnectDeclined(t *testing.T) {
+	var paths []string
+	config := Config{OnRequest: func(req *http.Request) error {
+		paths = append(paths, req.URL.String())
+		return nil
+	}}
+	mc := &mockConn{readData: []byte(
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n" +
+			"GET http://example.com/after?x=1 HTTP/1.1\r\nHost: example.com\r\n\r\n")}
+	conn := newInspectedConn(mc, config, false)
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs := readRequests(t, string(buf[:n])); len(reqs) != 1 {
+		t.Fatalf("got %d requests before the CONNECT was answered", len(reqs))
+	}
+	// Refusing the CONNECT releases the request that followed it as HTTP.
+	io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+	rest, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := readRequests(t, string(rest))
+	if len(reqs) != 1 || reqs[0].RequestURI != "http://example.com/after?x=1" {
+		t.Fatalf("got %q", rest)
+	}
+	if len(paths) != 2 || paths[1] != "http://example.com/after?x=1" {
+		t.Errorf("OnRequest saw %v", paths)
+	}
+}
+
+func TestInspectorAbsoluteForm(t *testing.T) {
+	config := Config{OnRequest: func(req *http.Request) error {
+		if req.URL.Scheme != "http" || req.URL.Host != "example.com" || req.URL.Path != "/a" {
+			t.Errorf("callback saw URL %q", req.URL)
+		}
+		req.URL.Host = "mirror.example.com"
+		return nil
+	}}
+	in := "GET http://example.com/a HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	conn := newInspectedConn(&mockConn{readData: []byte(in)}, config, false)
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "GET http://mirror.example.com/a HTTP/1.1\r\nHost: mirror.example.com\r\n\r\n"
+	if string(out) != want {
+		t.Errorf("got %q", out)
+	}
+}
+
+func TestInspectorUpgrade(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests, upgrades []string
+	config := Config{
+		OnRequest: func(req *http.Request) error {
+			requests = append(requests, req.URL.Path)
+			return nil
+		},
+		OnUpgrade: func(req *http.Request, protocol string) error {
+			upgrades = append(upgrades, protocol)
+			if protocol == "h2c" {
+				return &Reject{Status: http.StatusForbidden}
+			}
+			return nil
+		},
+		UpgradeInspectors: map[string]TunnelCallback{
+			"WebSocket": func(resp *http.Response, conn net.Conn) net.Conn { return upperConn{conn} },
+		},
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			io.WriteString(w, "plain")
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+		line, _ := brw.ReadString('\n')
+		conn.Write([]byte(line))
+	})}
+	go server.Serve(New(l, config))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	io.WriteString(conn, "GET /h2c HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA\r\n\r\n")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("rejected upgrade got %s", resp.Status)
+	}
+
+	// Bytes after the upgrade look like HTTP, but belong to the new protocol.
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"+
+		"GET /inner HTTP/1.1\r\n\r\n")
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade got %s", resp.Status)
+	}
+	line, err := br.ReadString('\n')
+	if err != nil || line != "GET /INNER HTTP/1.1\r\n" {
+		t.Errorf("upgraded connection echoed %q, %v", line, err)
+	}
+	if fmt.Sprint(requests) != "[/h2c /ws]" || fmt.Sprint(upgrades) != "[h2c websocket]" {
+		t.Errorf("saw requests %v and upgrades %v", requests, upgrades)
+	}
+}
+
+func TestInspectorUpgradeDeclined(t *testing.T) {
+	var paths []string
+	config := Config{OnRequest: func(req *http.Request) error {
+		paths = append(paths, req.URL.Path)
+		return nil
+	}}
+	mc := &mockConn{readData: []byte(
+		"GET /ws HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n" +
+			"GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n")}
+	conn := newInspectedConn(mc, config, false)
+	buf := make([]byte, 1024)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	// A server that ignores the Upgrade header answers normally.
+	io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(paths) != "[/ws /next]" {
+		t.Errorf("OnRequest saw %v", paths)
+	}
+}
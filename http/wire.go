@@ -0,0 +1,273 @@
+package httpinspector
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// framing describes how the body of a message is delimited on the wire.
+type framing int
+
+const (
+	frameNone    framing = iota // The message has no body
+	frameLength                 // The body is Content-Length bytes long
+	frameChunked                // The body uses chunked transfer-coding
+	frameEOF                    // The body runs until the connection closes
+)
+
+// framingHeaders lists the header fields the inspector writes itself, from
+// the framing of the message, rather than copying from the Header map.
+var framingHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+}
+
+// headEnd returns the length of the header block at the start of b,
+// including the blank line that ends it, or -1 if it is incomplete.
+func headEnd(b []byte) int {
+	end := -1
+	if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+		end = i + 4
+	}
+	if i := bytes.Index(b, []byte("\n\n")); i >= 0 && (end < 0 || i+2 < end) {
+		end = i + 2
+	}
+	return end
+}
+
+// isChunked reports whether the transfer codings end in chunked.
+func isChunked(te []string) bool {
+	return len(te) > 0 && strings.EqualFold(te[len(te)-1], "chunked")
+}
+
+// requestFraming returns how the body of req is delimited.
+func requestFraming(req *http.Request) framing {
+	switch {
+	case isChunked(req.TransferEncoding):
+		return frameChunked
+	case req.ContentLength > 0:
+		return frameLength
+	}
+	return frameNone
+}
+
+// responseFraming returns how the body of resp is delimited, given the
+// method of the request it answers.
+func responseFraming(resp *http.Response, method string) framing {
+	switch {
+	case method == http.MethodHead,
+		resp.StatusCode >= 100 && resp.StatusCode < 200,
+		resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusNotModified,
+		method == http.MethodConnect && resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return frameNone
+	case isChunked(resp.TransferEncoding):
+		return frameChunked
+	case resp.ContentLength >= 0:
+		return frameLength
+	}
+	return frameEOF
+}
+
+// writeFraming writes the header fields announcing the framing of a body.
+// Messages without a body keep the Content-Length and Transfer-Encoding they
+// arrived with, since those may describe another message (for instance the
+// response to a HEAD request).
+func writeFraming(buf *bytes.Buffer, f framing, length int64, header http.Header, te []string) {
+	switch f {
+	case frameLength:
+		fmt.Fprintf(buf, "Content-Length: %d\r\n", length)
+	case frameChunked:
+		buf.WriteString("Transfer-Encoding: chunked\r\n")
+	case frameNone:
+		for _, v := range header["Content-Length"] {
+			fmt.Fprintf(buf, "Content-Length: %s\r\n", v)
+		}
+		if len(te) > 0 {
+			fmt.Fprintf(buf, "Transfer-Encoding: %s\r\n", strings.Join(te, ", "))
+		}
+	}
+}
+
+// writeRequestHead serializes the request line and header block of req.
+// The request-target the client sent is kept unless a callback changed the
+// URL; origURL is the URL as it was parsed.
+func writeRequestHead(buf *bytes.Buffer, req *http.Request, origURL string, f framing, length int64) {
+	target := req.RequestURI
+	if req.URL.String() != origURL || target == "" {
+		switch {
+		case req.Method == http.MethodConnect && req.URL.Path == "":
+			target = req.URL.Host
+		case req.URL.Scheme != "":
+			target = req.URL.String()
+		default:
+			target = req.URL.RequestURI()
+		}
+	}
+	fmt.Fprintf(buf, "%s %s %s\r\n", req.Method, target, protoOrDefault(req.Proto))
+	host := req.Host
+	if req.URL.Scheme != "" && req.URL.Host != "" {
+		// A callback that points an absolute-form request elsewhere need
+		// not update Host; the recipient goes by the request-target.
+		if orig, err := url.Parse(origURL); err == nil && orig.Host == host {
+			host = req.URL.Host
+		}
+	}
+	if host != "" {
+		fmt.Fprintf(buf, "Host: %s\r\n", host)
+	}
+	writeFraming(buf, f, length, req.Header, req.TransferEncoding)
+	req.Header.WriteSubset(buf, framingHeaders)
+	buf.WriteString("\r\n")
+}
+
+// writeResponseHead serializes the status line and header block of resp.
+func writeResponseHead(buf *bytes.Buffer, resp *http.Response, f framing, length int64) {
+	code := strconv.Itoa(resp.StatusCode)
+	status := resp.Status
+	if status != code && !strings.HasPrefix(status, code+" ") {
+		status = code + " " + http.StatusText(resp.StatusCode)
+	}
+	fmt.Fprintf(buf, "%s %s\r\n", protoOrDefault(resp.Proto), status)
+	writeFraming(buf, f, length, resp.Header, resp.TransferEncoding)
+	resp.Header.WriteSubset(buf, framingHeaders)
+	buf.WriteString("\r\n")
+}
+
+func protoOrDefault(proto string) string {
+	if proto == "" {
+		return "HTTP/1.1"
+	}
+	return proto
+}
+
+// lastChunk ends a body sent with chunked transfer-coding.
+const lastChunk = "0\r\n\r\n"
+
+// appendChunk appends b to out as a single chunk. Empty data is skipped,
+// since an empty chunk would end the body.
+func appendChunk(out, b []byte) []byte {
+	if len(b) == 0 {
+		return out
+	}
+	out = strconv.AppendInt(out, int64(len(b)), 16)
+	out = append(out, "\r\n"...)
+	out = append(out, b...)
+	return append(out, "\r\n"...)
+}
+
+// chunkState is the position of a bodyFramer within the chunked coding.
+type chunkState int
+
+const (
+	chunkSize chunkState = iota
+	chunkData
+	chunkDataEnd
+	chunkTrailer
+)
+
+// maxChunkLine bounds chunk-size and trailer lines.
+const maxChunkLine = 4096
+
+// bodyFramer follows the framing of a message body as its bytes arrive,
+// finding where the body ends and which bytes are payload.
+type bodyFramer struct {
+	framing   framing
+	remaining int64
+	state     chunkState
+}
+
+// advance consumes the next piece of raw body bytes from b. It returns the
+// number of bytes consumed, the payload among them, and whether the body is
+// complete. A result consuming nothing without completing the body means
+// more input is needed.
+func (f *bodyFramer) advance(b []byte, eof bool) (n int, data []byte, done bool, err error) {
+	switch f.framing {
+	case frameNone:
+		return 0, nil, true, nil
+	case frameEOF:
+		return len(b), b, eof, nil
+	case frameLength:
+		n = len(b)
+		if int64(n) > f.remaining {
+			n = int(f.remaining)
+		}
+		f.remaining -= int64(n)
+		return n, b[:n], f.remaining == 0, nil
+	}
+
+	switch f.state {
+	case chunkSize:
+		line, ok := chunkLine(b)
+		if !ok {
+			return 0, nil, false, checkChunkLine(b)
+		}
+		size := strings.TrimSpace(string(line))
+		if i := strings.IndexByte(size, ';'); i >= 0 {
+			size = strings.TrimSpace(size[:i])
+		}
+		f.remaining, err = strconv.ParseInt(size, 16, 64)
+		if err != nil || f.remaining < 0 {
+			return 0, nil, false, fmt.Errorf("%w: bad chunk size %q", ErrMalformedHTTP, size)
+		}
+		f.state = chunkData
+		if f.remaining == 0 {
+			f.state = chunkTrailer
+		}
+		return len(line), nil, false, nil
+	case chunkData:
+		n = len(b)
+		if int64(n) > f.remaining {
+			n = int(f.remaining)
+		}
+		f.remaining -= int64(n)
+		if f.remaining == 0 {
+			f.state = chunkDataEnd
+		}
+		return n, b[:n], false, nil
+	case chunkDataEnd:
+		switch {
+		case bytes.HasPrefix(b, []byte("\n")):
+			n = 1
+		case bytes.HasPrefix(b, []byte("\r\n")):
+			n = 2
+		case len(b) == 0, len(b) == 1 && b[0] == '\r':
+			return 0, nil, false, nil
+		default:
+			return 0, nil, false, fmt.Errorf("%w: missing CRLF after chunk", ErrMalformedHTTP)
+		}
+		f.state = chunkSize
+		return n, nil, false, nil
+	default: // chunkTrailer
+		line, ok := chunkLine(b)
+		if !ok {
+			return 0, nil, false, checkChunkLine(b)
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			f.state = chunkSize
+			return len(line), nil, true, nil
+		}
+		return len(line), nil, false, nil
+	}
+}
+
+// chunkLine returns the LF-terminated line at the start of b.
+func chunkLine(b []byte) ([]byte, bool) {
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return nil, false
+	}
+	return b[:i+1], true
+}
+
+func checkChunkLine(b []byte) error {
+	if len(b) > maxChunkLine {
+		return fmt.Errorf("%w: chunk line too long", ErrMalformedHTTP)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package ircinspector
+
+import (
+	"context"
+	"net"
+)
+
+// Dialer dials outbound IRC connections inspected with the same configuration
+// and filters as an Inspector
+type Dialer struct {
+	dial      func(ctx context.Context, network, address string) (net.Conn, error)
+	inspector *Inspector
+}
+
+// NewDialer creates a new IRC dialer. dial may be the DialContext method of a
+// net.Dialer or any function with the same signature; if it is nil a zero
+// net.Dialer is used
+func NewDialer(dial func(ctx context.Context, network, address string) (net.Conn, error), config Config) *Dialer {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	return &Dialer{
+		dial:      dial,
+		inspector: New(nil, config),
+	}
+}
+
+// AddFilter adds a filter applied to messages on dialed connections
+func (d *Dialer) AddFilter(filter Filter) {
+	d.inspector.AddFilter(filter)
+}
+
+// Dial connects to the address on the named network
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network using the
+// provided context
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ircConn{
+		Conn:      conn,
+		inspector: d.inspector,
+		client:    true,
+	}, nil
+}
@@ -0,0 +1,66 @@
+package ircinspector
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string, 2)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			line, _ := br.ReadString('\n')
+			received <- line
+		}
+		conn.Write([]byte(":server PRIVMSG me :hello\r\n"))
+	}()
+
+	dialer := NewDialer(nil, Config{
+		OnMessage: func(msg *Message) error {
+			msg.Tags["+seen"] = ""
+			return nil
+		},
+		Logger: nopLogger{},
+	})
+	dialer.AddFilter(Filter{
+		Command: "PRIVMSG",
+		Callback: func(msg *Message) error {
+			msg.Trailing = strings.ToUpper(msg.Trailing)
+			return nil
+		},
+	})
+	conn, err := dialer.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("NICK me\r\nPRIVMSG #chan :hi there\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"@+seen NICK me\r\n", "@+seen PRIVMSG #chan :HI THERE\r\n"} {
+		if got := <-received; got != want {
+			t.Errorf("server got %q, want %q", got, want)
+		}
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "@+seen :server PRIVMSG me :HELLO\r\n"; line != want {
+		t.Errorf("client got %q, want %q", line, want)
+	}
+}
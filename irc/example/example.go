@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"net"
 
@@ -24,11 +23,23 @@ func main() {
 		},
 	})
 
-	// Block NICK changes
+	// Block NICK changes, answering the client with ERR_ERRONEUSNICKNAME.
+	// NICK messages from the server announce other users' changes, and are
+	// left alone
 	inspector.AddFilter(ircinspector.Filter{
-		Command: "NICK",
+		Command:   "NICK",
+		Direction: ircinspector.FromClient,
 		Callback: func(msg *ircinspector.Message) error {
-			return fmt.Errorf("NICK changes not allowed")
+			nick := msg.Trailing
+			if len(msg.Params) > 0 {
+				nick = msg.Params[0]
+			}
+			return ircinspector.Reject(&ircinspector.Message{
+				Command:     "432",
+				Params:      []string{"*", nick},
+				Trailing:    "NICK changes not allowed",
+				HasTrailing: true,
+			})
 		},
 	})
 
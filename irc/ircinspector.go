@@ -2,11 +2,14 @@ package ircinspector
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
 type defaultLogger struct{}
@@ -61,8 +64,19 @@ func (i *Inspector) Addr() net.Addr {
 type ircConn struct {
 	net.Conn
 	inspector *Inspector
+	client    bool // The connection was dialed, so written messages come from the client
 	reader    *bufio.Reader
-	writer    *bufio.Writer
+	line      string // Part of a line read before Read was interrupted
+	pending   []byte // Inspected bytes not yet returned by Read
+	readErr   error  // Error to return once pending is empty
+
+	writeMu sync.Mutex
+	partial []byte // Written bytes not yet ending a line
+
+	mu           sync.Mutex
+	replies      []byte    // Replies to written messages, for Read to return
+	readDeadline time.Time // The read deadline set by the user
+	woken        bool      // The read deadline was moved to interrupt Read
 }
 
 func (c *ircConn) Read(b []byte) (n int, err error) {
@@ -70,53 +84,233 @@ func (c *ircConn) Read(b []byte) (n int, err error) {
 		c.reader = bufio.NewReader(c.Conn)
 	}
 
-	line, err := c.reader.ReadString('\n')
-	if err != nil {
-		return 0, err
+	for len(c.pending) == 0 {
+		if c.takeReplies() {
+			continue
+		}
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		line, err := c.reader.ReadString('\n')
+		c.line += line
+		if err != nil {
+			if c.unwake() {
+				continue
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// Keep the partial line for the next Read.
+				return 0, err
+			}
+			c.readErr = err
+		}
+		if c.line != "" {
+			out, replies := c.inspect(c.line, false)
+			c.pending = append(c.pending, out...)
+			c.line = ""
+			if len(replies) > 0 {
+				c.writeMu.Lock()
+				_, err := c.Conn.Write(replies)
+				c.writeMu.Unlock()
+				if err != nil {
+					c.inspector.config.Logger.Error("reply error: %v", err)
+				}
+			}
+		}
 	}
 
-	msg, err := parseMessage(line)
-	if err != nil {
-		c.inspector.config.Logger.Error("parse error: %v", err)
-		copy(b, line)
-		return len(line), nil
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write inspects each line written. A line is held until its line ending
+// is written.
+func (c *ircConn) Write(b []byte) (n int, err error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.partial = append(c.partial, b...)
+	var out, replies []byte
+	for {
+		i := bytes.IndexByte(c.partial, '\n')
+		if i < 0 {
+			break
+		}
+		o, r := c.inspect(string(c.partial[:i+1]), true)
+		out = append(out, o...)
+		replies = append(replies, r...)
+		c.partial = c.partial[i+1:]
+	}
+	if len(c.partial) == 0 {
+		c.partial = nil
 	}
 
-	if err := c.inspector.processMessage(msg); err != nil {
-		c.inspector.config.Logger.Error("process error: %v", err)
+	if len(replies) > 0 {
+		c.mu.Lock()
+		c.replies = append(c.replies, replies...)
+		c.mu.Unlock()
+		if err := c.wake(); err != nil {
+			c.inspector.config.Logger.Error("replies wait for the next read: %v", err)
+		}
 	}
+	if len(out) > 0 {
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
 
-	modified := msg.String()
-	copy(b, modified)
-	return len(modified), nil
+// Close inspects a partial line that was written before closing the
+// connection, and forwards what the callbacks leave of it. Replies to it
+// are dropped, as nothing can read them once the connection is closed
+func (c *ircConn) Close() error {
+	c.writeMu.Lock()
+	if len(c.partial) > 0 {
+		if out, _ := c.inspect(string(c.partial), true); len(out) > 0 {
+			c.Conn.Write(out)
+		}
+		c.partial = nil
+	}
+	c.writeMu.Unlock()
+	return c.Conn.Close()
 }
 
-func (c *ircConn) Write(b []byte) (n int, err error) {
-	if c.writer == nil {
-		c.writer = bufio.NewWriter(c.Conn)
-		defer c.writer.Flush()
+// SetDeadline implements the net.Conn SetDeadline method
+func (c *ircConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if c.woken {
+		return c.Conn.SetWriteDeadline(t)
 	}
-	msg, err := parseMessage(string(b))
-	if err != nil {
-		return c.writer.Write(b)
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements the net.Conn SetReadDeadline method
+func (c *ircConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	if c.woken {
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// wake interrupts a Read blocked on the underlying connection by moving its
+// read deadline into the past, so that it returns the replies to written
+// messages. On connections without deadline support it fails, and the
+// replies are only returned once Read returns from the connection
+func (c *ircConn) wake() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.Conn.SetReadDeadline(time.Unix(1, 0)); err != nil {
+		return err
+	}
+	c.woken = true
+	return nil
+}
+
+// unwake restores the read deadline after wake, reporting whether Read was
+// interrupted
+func (c *ircConn) unwake() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.woken {
+		return false
+	}
+	c.woken = false
+	if err := c.Conn.SetReadDeadline(c.readDeadline); err != nil {
+		c.inspector.config.Logger.Error("read deadline not restored: %v", err)
+	}
+	return true
+}
+
+// takeReplies moves the replies to written messages to the bytes Read
+// returns, reporting whether there were any
+func (c *ircConn) takeReplies() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.replies) == 0 {
+		return false
 	}
+	c.pending = append(c.pending, c.replies...)
+	c.replies = nil
+	return true
+}
 
-	defer c.writer.Flush()
+// inspect runs the callbacks on a line. It returns the bytes to forward in
+// its place, which are the line itself unless a callback modified or
+// replaced the message, and the replies to send back to its sender.
+// written tells whether the line was written to the connection or read
+// from it
+func (c *ircConn) inspect(line string, written bool) (out, replies []byte) {
+	msg, err := parseMessage(line)
+	if err != nil {
+		c.inspector.config.Logger.Error("parse error: %v", err)
+		return []byte(line), nil
+	}
+	msg.Direction = FromServer
+	if written == c.client {
+		msg.Direction = FromClient
+	}
 
-	if err := c.inspector.processMessage(msg); err != nil {
+	orig := msg.clone()
+	err = c.inspector.processMessage(msg)
+	var verdict *Verdict
+	if err != nil && !errors.As(err, &verdict) {
 		c.inspector.config.Logger.Error("process error: %v", err)
+		return nil, nil
+	}
+	if verdict == nil {
+		verdict = &Verdict{Action: Pass}
 	}
 
-	return c.writer.Write([]byte(msg.String()))
+	replies = formatMessages(verdict.Replies, msg.lineEnding())
+	switch verdict.Action {
+	case Drop:
+		return nil, replies
+	case Replace:
+		return formatMessages(verdict.Messages, msg.lineEnding()), replies
+	}
+	if !msg.modified(orig) {
+		return []byte(line), replies
+	}
+	return []byte(msg.format() + msg.lineEnding()), replies
 }
 
-func parseMessage(raw string) (*Message, error) {
-	raw = strings.TrimSpace(raw)
-	if raw == "" {
+func parseMessage(line string) (*Message, error) {
+	msg := &Message{}
+	raw := line
+	switch {
+	case strings.HasSuffix(raw, "\r\n"):
+		msg.eol = "\r\n"
+	case strings.HasSuffix(raw, "\n"):
+		msg.eol = "\n"
+	}
+	raw = strings.TrimSuffix(raw, msg.eol)
+	msg.Raw = raw
+
+	raw = strings.TrimLeft(raw, " ")
+	if strings.TrimSpace(raw) == "" {
 		return nil, fmt.Errorf("empty message")
 	}
 
-	msg := &Message{Raw: raw}
+	if raw[0] == '@' {
+		parts := strings.SplitN(raw[1:], " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid message format")
+		}
+		msg.Tags = parseTags(parts[0])
+		raw = strings.TrimLeft(parts[1], " ")
+	} else {
+		msg.Tags = make(map[string]string)
+	}
+
+	if raw == "" {
+		return nil, fmt.Errorf("no command found")
+	}
 
 	if raw[0] == ':' {
 		parts := strings.SplitN(raw[1:], " ", 2)
@@ -130,6 +324,7 @@ func parseMessage(raw string) (*Message, error) {
 	parts := strings.SplitN(raw, " :", 2)
 	if len(parts) > 1 {
 		msg.Trailing = parts[1]
+		msg.HasTrailing = true
 	}
 
 	words := strings.Fields(parts[0])
@@ -185,6 +380,9 @@ func (i *Inspector) processMessage(msg *Message) error {
 
 	// Process filters
 	for _, filter := range i.filters {
+		if filter.Direction != 0 && filter.Direction != msg.Direction {
+			continue
+		}
 		if filter.Command == "" || filter.Command == msg.Command {
 			if err := filter.Callback(msg); err != nil {
 				return err
@@ -0,0 +1,466 @@
+package ircinspector
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bufferConn is a net.Conn reading from a reader and writing into a buffer.
+type bufferConn struct {
+	net.Conn
+	r       io.Reader
+	written bytes.Buffer
+}
+
+func (c *bufferConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferConn) Close() error {
+	return nil
+}
+
+func (c *bufferConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+// readingConn tells when Read is first called on it.
+type readingConn struct {
+	net.Conn
+	once    sync.Once
+	reading chan struct{}
+}
+
+func (c *readingConn) Read(b []byte) (int, error) {
+	c.once.Do(func() { close(c.reading) })
+	return c.Conn.Read(b)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(format string, args ...interface{}) {}
+func (nopLogger) Error(format string, args ...interface{}) {}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		raw  string
+		tags map[string]string
+		want string // String() of the parsed message
+	}{
+		{
+			raw:  "@time=2023-01-01T00:00:00.000Z;msgid=abc :nick!user@host PRIVMSG #chan :hello world",
+			tags: map[string]string{"time": "2023-01-01T00:00:00.000Z", "msgid": "abc"},
+			want: "@msgid=abc;time=2023-01-01T00:00:00.000Z :nick!user@host PRIVMSG #chan :hello world\r\n",
+		},
+		{
+			raw:  `@+example.com/note=a\sb\:c\\d\re\nf;flag;empty= PING :x`,
+			tags: map[string]string{"+example.com/note": "a b;c\\d\re\nf", "flag": "", "empty": ""},
+			want: `@+example.com/note=a\sb\:c\\d\re\nf;empty;flag PING :x` + "\r\n",
+		},
+		{
+			raw:  `@a=\q\;b=trailing\ PING`,
+			tags: map[string]string{"a": "q", "b": "trailing"},
+			want: "@a=q;b=trailing PING\r\n",
+		},
+		{
+			raw:  "@a=1;a=2  :server 001 nick :Welcome",
+			tags: map[string]string{"a": "2"},
+			want: "@a=2 :server 001 nick :Welcome\r\n",
+		},
+		{
+			raw:  ":server NOTICE * :no tags",
+			tags: map[string]string{},
+			want: ":server NOTICE * :no tags\r\n",
+		},
+	}
+	for _, tt := range tests {
+		msg, err := parseMessage(tt.raw)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.raw, err)
+		}
+		if !reflect.DeepEqual(msg.Tags, tt.tags) {
+			t.Errorf("%q: got tags %q, want %q", tt.raw, msg.Tags, tt.tags)
+		}
+		got := msg.String()
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.raw, got, tt.want)
+		}
+		again, err := parseMessage(got)
+		if err != nil {
+			t.Fatalf("%q: %v", got, err)
+		}
+		if again.modified(msg) {
+			t.Errorf("%q: round trip gave %+v, want %+v", tt.raw, again, msg)
+		}
+	}
+
+	for _, raw := range []string{"@a=1", "@a=1 ", "@"} {
+		if _, err := parseMessage(raw); err == nil {
+			t.Errorf("%q: parsed without a command", raw)
+		}
+	}
+}
+
+func TestTagValueEscaping(t *testing.T) {
+	for _, value := range []string{"", "plain", "a;b c\\d\r\n", `\:\s`, ";;  \\\\"} {
+		escaped := escapeTagValue(value)
+		for _, c := range []byte{';', ' ', '\r', '\n'} {
+			if bytes.IndexByte([]byte(escaped), c) >= 0 {
+				t.Errorf("%q escaped as %q", value, escaped)
+			}
+		}
+		if got := unescapeTagValue(escaped); got != value {
+			t.Errorf("%q escaped as %q unescaped as %q", value, escaped, got)
+		}
+	}
+}
+
+func TestCallbackTags(t *testing.T) {
+	inspector := New(nil, Config{
+		OnMessage: func(msg *Message) error {
+			delete(msg.Tags, "msgid")
+			msg.Tags["+proxy"] = "seen by; proxy"
+			return nil
+		},
+	})
+	conn := &bufferConn{}
+	c := &ircConn{Conn: conn, inspector: inspector}
+	for _, line := range []string{"@msgid=1;time=now PRIVMSG #chan :hi\r\n", "PING :server\r\n"} {
+		if _, err := c.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := `@+proxy=seen\sby\:\sproxy;time=now PRIVMSG #chan :hi` + "\r\n" +
+		`@+proxy=seen\sby\:\sproxy PING :server` + "\r\n"
+	if got := conn.written.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// roundTripInput holds lines that re-serializing would change.
+const roundTripInput = "PRIVMSG #a :\r\n" +
+	"PRIVMSG  #a   b  :two  spaces  \r\n" +
+	"@z=1;a=2 :nick!u@h NOTICE #a :lf only\n" +
+	"@a=\\q PING\r\n" +
+	"\r\n" +
+	"  :server 001 nick :Welcome\r\n" +
+	"NICK unterminated"
+
+func TestRoundTrip(t *testing.T) {
+	var seen []*Message
+	inspector := New(nil, Config{
+		OnMessage: func(msg *Message) error {
+			seen = append(seen, msg)
+			return nil
+		},
+		Logger: nopLogger{},
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		// Read a few bytes at a time, so that lines do not fit.
+		c := &ircConn{Conn: &bufferConn{r: strings.NewReader(roundTripInput)}, inspector: inspector}
+		var got []byte
+		b := make([]byte, 5)
+		for {
+			n, err := c.Read(b)
+			got = append(got, b[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(got) != roundTripInput {
+			t.Errorf("got %q", got)
+		}
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		conn := &bufferConn{}
+		c := &ircConn{Conn: conn, inspector: inspector}
+		for i := 0; i < len(roundTripInput); i += 7 {
+			end := min(i+7, len(roundTripInput))
+			if n, err := c.Write([]byte(roundTripInput[i:end])); err != nil || n != end-i {
+				t.Fatalf("Write returned %d, %v", n, err)
+			}
+		}
+		c.Close()
+		if got := conn.written.String(); got != roundTripInput {
+			t.Errorf("got %q", got)
+		}
+	})
+
+	if len(seen) != 12 {
+		t.Fatalf("callback saw %d messages", len(seen))
+	}
+	if m := seen[0]; m.Raw != "PRIVMSG #a :" || !m.HasTrailing || m.Trailing != "" {
+		t.Errorf("got %+v", m)
+	}
+	if m := seen[1]; m.Trailing != "two  spaces  " || len(m.Params) != 2 {
+		t.Errorf("got %+v", m)
+	}
+}
+
+func TestModifiedMessage(t *testing.T) {
+	inspector := New(nil, Config{})
+	inspector.AddFilter(Filter{
+		Command: "PRIVMSG",
+		Callback: func(msg *Message) error {
+			msg.Params[0] = "#b"
+			return nil
+		},
+	})
+	in := "PRIVMSG  #a :\n" + "PRIVMSG #a :hi\r\n" + "PING :x\n"
+	want := "PRIVMSG #b :\n" + "PRIVMSG #b :hi\r\n" + "PING :x\n"
+	conn := &bufferConn{}
+	c := &ircConn{Conn: conn, inspector: inspector}
+	if _, err := c.Write([]byte(in)); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.written.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestClosePartialLine(t *testing.T) {
+	inspector := New(nil, Config{})
+	inspector.AddFilter(Filter{
+		Command: "NICK",
+		Callback: func(msg *Message) error {
+			if msg.Params[0] == "badnick" {
+				return Reject(&Message{Command: "432", Params: []string{"*", "badnick"}})
+			}
+			msg.Params[0] = "renamed"
+			return nil
+		},
+	})
+	for _, tt := range []struct{ in, want string }{
+		{"PING :x\r\nNICK badnick", "PING :x\r\n"},
+		{"NICK good", "NICK renamed\r\n"},
+		{"PING :unterminated", "PING :unterminated"},
+	} {
+		conn := &bufferConn{}
+		c := &ircConn{Conn: conn, inspector: inspector}
+		if _, err := c.Write([]byte(tt.in)); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if got := conn.written.String(); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestVerdicts(t *testing.T) {
+	inspector := New(nil, Config{Logger: nopLogger{}})
+	inspector.AddFilter(Filter{
+		Command: "QUIT",
+		Callback: func(msg *Message) error {
+			return errors.New("not allowed")
+		},
+	})
+	inspector.AddFilter(Filter{
+		Command: "AWAY",
+		Callback: func(msg *Message) error {
+			return DropMessage()
+		},
+	})
+	inspector.AddFilter(Filter{
+		Command: "JOIN",
+		Callback: func(msg *Message) error {
+			// Split a JOIN of several channels.
+			var msgs []*Message
+			for _, channel := range strings.Split(msg.Params[0], ",") {
+				msgs = append(msgs, &Message{Command: "JOIN", Params: []string{channel}})
+			}
+			return ReplaceMessage(msgs...)
+		},
+	})
+	inspector.AddFilter(Filter{
+		Command: "NICK",
+		Callback: func(msg *Message) error {
+			return Reject(&Message{
+				Prefix:      "proxy",
+				Command:     "432",
+				Params:      []string{"*", msg.Params[0]},
+				Trailing:    "Erroneous nickname",
+				HasTrailing: true,
+			})
+		},
+	})
+	inspector.AddFilter(Filter{
+		Command: "PRIVMSG",
+		Callback: func(msg *Message) error {
+			return &Verdict{Action: Pass, Replies: []*Message{{Command: "NOTICE", Params: []string{"me"}, Trailing: "logged"}}}
+		},
+	})
+	in := "QUIT :bye\r\nAWAY :lunch\r\nJOIN #a,#b\nNICK bad\r\nPRIVMSG #a :hi\r\nPING :x\r\n"
+	forwarded := "JOIN #a\nJOIN #b\nPRIVMSG #a :hi\r\nPING :x\r\n"
+	replies := ":proxy 432 * bad :Erroneous nickname\r\nNOTICE me :logged\r\n"
+
+	t.Run("Read", func(t *testing.T) {
+		peer, conn := net.Pipe()
+		defer peer.Close()
+		c := &ircConn{Conn: conn, inspector: inspector}
+		go func() {
+			peer.Write([]byte(in))
+		}()
+		answered := make(chan string)
+		go func() {
+			b := make([]byte, len(replies))
+			n, _ := io.ReadFull(peer, b)
+			answered <- string(b[:n])
+		}()
+		b := make([]byte, len(forwarded))
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != forwarded {
+			t.Errorf("read %q, %v", b, err)
+		}
+		if got := <-answered; got != replies {
+			t.Errorf("peer got %q", got)
+		}
+		c.Close()
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		peer, conn := net.Pipe()
+		defer peer.Close()
+		reading := &readingConn{Conn: conn, reading: make(chan struct{})}
+		c := &ircConn{Conn: reading, inspector: inspector}
+		read := make(chan string)
+		go func() {
+			// Blocked until the replies arrive.
+			b := make([]byte, len(replies))
+			n, err := io.ReadFull(c, b)
+			if err != nil {
+				t.Error(err)
+			}
+			read <- string(b[:n])
+		}()
+		sent := make(chan string)
+		go func() {
+			b := make([]byte, len(forwarded))
+			n, _ := io.ReadFull(peer, b)
+			sent <- string(b[:n])
+		}()
+		<-reading.reading
+		if _, err := c.Write([]byte(in)); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-sent; got != forwarded {
+			t.Errorf("peer got %q", got)
+		}
+		if got := <-read; got != replies {
+			t.Errorf("read %q", got)
+		}
+
+		// The read deadline still applies after the interruption.
+		c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, err := c.Read(make([]byte, 1)); err == nil {
+			t.Error("read past the deadline")
+		}
+		c.Close()
+	})
+}
+
+func TestDirection(t *testing.T) {
+	var seen []Direction
+	inspector := New(nil, Config{
+		OnMessage: func(msg *Message) error {
+			seen = append(seen, msg.Direction)
+			return nil
+		},
+	})
+	inspector.AddFilter(Filter{
+		Command:   "NICK",
+		Direction: FromClient,
+		Callback: func(msg *Message) error {
+			return Reject(&Message{Command: "432", Params: []string{"*", msg.Params[0]}})
+		},
+	})
+	// Another user's change of nick, as the server announces it
+	announce := ":bob!u@h NICK bob2\r\n"
+
+	t.Run("Accepted", func(t *testing.T) {
+		seen = nil
+		conn := &bufferConn{r: strings.NewReader("NICK bad\r\n")}
+		c := &ircConn{Conn: conn, inspector: inspector}
+		if _, err := c.Write([]byte(announce)); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := io.ReadAll(c); len(got) != 0 {
+			t.Errorf("read %q", got)
+		}
+		// The rejected client message is answered; the announcement is
+		// forwarded to the client.
+		if got, want := conn.written.String(), announce+"432 * bad\r\n"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if !reflect.DeepEqual(seen, []Direction{FromServer, FromClient}) {
+			t.Errorf("directions %v", seen)
+		}
+	})
+
+	t.Run("Dialed", func(t *testing.T) {
+		seen = nil
+		conn := &bufferConn{r: strings.NewReader(announce)}
+		c := &ircConn{Conn: conn, inspector: inspector, client: true}
+		if got, _ := io.ReadAll(c); string(got) != announce {
+			t.Errorf("read %q", got)
+		}
+		if !reflect.DeepEqual(seen, []Direction{FromServer}) || conn.written.Len() != 0 {
+			t.Errorf("directions %v, wrote %q", seen, conn.written.String())
+		}
+	})
+}
+
+// noDeadlineConn is a bufferConn without deadline support.
+type noDeadlineConn struct {
+	bufferConn
+}
+
+func (c *noDeadlineConn) SetReadDeadline(t time.Time) error {
+	return errors.New("deadlines not supported")
+}
+
+// errorLogger records the errors logged.
+type errorLogger struct {
+	nopLogger
+	errors []string
+}
+
+func (l *errorLogger) Error(format string, args ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+func TestRepliesWithoutDeadlines(t *testing.T) {
+	logger := &errorLogger{}
+	inspector := New(nil, Config{Logger: logger})
+	inspector.AddFilter(Filter{
+		Command: "PING",
+		Callback: func(msg *Message) error {
+			return Reject(&Message{Command: "PONG", Params: msg.Params})
+		},
+	})
+	conn := &noDeadlineConn{bufferConn{r: strings.NewReader(":server NOTICE me :hi\r\n")}}
+	c := &ircConn{Conn: conn, inspector: inspector}
+	if _, err := c.Write([]byte("PING x\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.errors) != 1 || !strings.Contains(logger.errors[0], "deadlines not supported") {
+		t.Errorf("logged %q", logger.errors)
+	}
+	// The reply is still returned by the next Read.
+	got, _ := io.ReadAll(c)
+	if want := "PONG x\r\n:server NOTICE me :hi\r\n"; string(got) != want {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
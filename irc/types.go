@@ -8,15 +8,50 @@ import (
 
 // Message represents a parsed IRC message
 type Message struct {
-	Raw      string
+	// Raw is the message as it was received, without its line ending. It is
+	// forwarded byte for byte unless a callback changes another field
+	Raw string
+	// Tags holds the IRCv3 message tags, with their values unescaped.
+	// Parsed messages always have a map, so callbacks can add and remove
+	// tags directly
+	Tags     map[string]string
 	Prefix   string
 	Command  string
 	Params   []string
 	Trailing string
+	// HasTrailing is set if the message has a trailing parameter, which
+	// may then be empty, as in "PRIVMSG #chan :". A non-empty Trailing is
+	// sent whether or not it is set
+	HasTrailing bool
+	// Direction tells whether the client or the server sent the message.
+	// The inspector sets it on the messages it parses
+	Direction Direction
+
+	eol string // The line ending the message was received with
 }
 
+// Direction tells which side of an IRC connection sent a message
+type Direction int
+
+const (
+	// FromClient messages are sent by the client to the server: read from
+	// accepted connections, and written to dialed ones
+	FromClient Direction = iota + 1
+	// FromServer messages are sent by the server to the client: written to
+	// accepted connections, and read from dialed ones
+	FromServer
+)
+
 func (m *Message) String() string {
+	return m.format() + "\r\n"
+}
+
+// format serializes m without a line ending
+func (m *Message) format() string {
 	var parts []string
+	if len(m.Tags) > 0 {
+		parts = append(parts, "@"+formatTags(m.Tags))
+	}
 	if m.Prefix != "" {
 		parts = append(parts, ":"+m.Prefix)
 	}
@@ -24,18 +59,60 @@ func (m *Message) String() string {
 	if len(m.Params) > 0 {
 		parts = append(parts, strings.Join(m.Params, " "))
 	}
-	if m.Trailing != "" {
+	if m.Trailing != "" || m.HasTrailing {
 		parts = append(parts, ":"+m.Trailing)
 	}
-	return strings.Join(parts, " ") + "\r\n"
+	return strings.Join(parts, " ")
+}
+
+// lineEnding returns the line ending to send m with: the one it was
+// received with, or CRLF
+func (m *Message) lineEnding() string {
+	if m.eol == "" {
+		return "\r\n"
+	}
+	return m.eol
+}
+
+// clone returns a copy of m that shares nothing with it
+func (m *Message) clone() *Message {
+	c := *m
+	c.Params = append([]string(nil), m.Params...)
+	c.Tags = make(map[string]string, len(m.Tags))
+	for k, v := range m.Tags {
+		c.Tags[k] = v
+	}
+	return &c
+}
+
+// modified reports whether m differs from orig in anything but Raw
+func (m *Message) modified(orig *Message) bool {
+	if m.Prefix != orig.Prefix || m.Command != orig.Command || m.Trailing != orig.Trailing ||
+		m.HasTrailing != orig.HasTrailing || len(m.Params) != len(orig.Params) || len(m.Tags) != len(orig.Tags) {
+		return true
+	}
+	for i, p := range m.Params {
+		if p != orig.Params[i] {
+			return true
+		}
+	}
+	for k, v := range m.Tags {
+		if ov, ok := orig.Tags[k]; !ok || ov != v {
+			return true
+		}
+	}
+	return false
 }
 
 // Filter defines criteria for message filtering
 type Filter struct {
-	Command  string
-	Channel  string
-	Prefix   string
-	Callback func(*Message) error
+	Command string
+	Channel string
+	Prefix  string
+	// Direction restricts the filter to messages sent by one side; zero
+	// matches both
+	Direction Direction
+	Callback  func(*Message) error
 }
 
 // Config contains inspector configuration
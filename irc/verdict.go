@@ -0,0 +1,71 @@
+package ircinspector
+
+import "strings"
+
+// Action tells the inspector what to forward in place of a message
+type Action int
+
+const (
+	// Pass forwards the message, with any changes the callbacks made
+	Pass Action = iota
+	// Drop forwards nothing
+	Drop
+	// Replace forwards the messages of the Verdict instead, which may be
+	// any number of them
+	Replace
+)
+
+// Verdict decides what happens to a message. A callback returns one as its
+// error; it stops the callbacks that would run after it, like any error.
+// Callbacks returning other errors drop the message, and the error is
+// logged
+type Verdict struct {
+	Action   Action
+	Messages []*Message // Forwarded in place of the message, for Replace
+	// Replies are sent back to the sender of the message, whatever the
+	// action: to the peer for messages read from the connection, and
+	// returned by Read for messages written to it. Check the Direction of
+	// the message to only answer the client, or only the server. Replies to
+	// written messages interrupt a blocked Read through the read deadline of
+	// the connection, so they need a connection supporting deadlines, as TCP
+	// connections do; otherwise they wait until Read returns other data
+	Replies []*Message
+}
+
+// Error implements the error interface
+func (v *Verdict) Error() string {
+	switch v.Action {
+	case Pass:
+		return "irc message passed"
+	case Drop:
+		return "irc message dropped"
+	default:
+		return "irc message replaced"
+	}
+}
+
+// DropMessage returns a Verdict silently dropping the message
+func DropMessage() *Verdict {
+	return &Verdict{Action: Drop}
+}
+
+// ReplaceMessage returns a Verdict forwarding msgs in place of the message
+func ReplaceMessage(msgs ...*Message) *Verdict {
+	return &Verdict{Action: Replace, Messages: msgs}
+}
+
+// Reject returns a Verdict dropping the message and answering its sender
+// with replies instead, such as a numeric error reply
+func Reject(replies ...*Message) *Verdict {
+	return &Verdict{Action: Drop, Replies: replies}
+}
+
+// formatMessages serializes msgs, each ending with eol
+func formatMessages(msgs []*Message, eol string) []byte {
+	var b strings.Builder
+	for _, msg := range msgs {
+		b.WriteString(msg.format())
+		b.WriteString(eol)
+	}
+	return []byte(b.String())
+}
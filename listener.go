@@ -0,0 +1,105 @@
+package filter
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var ErrListenerClosed = errors.New("listener is closed")
+
+// Listener wraps a net.Listener and passes every connection it accepts through a factory,
+// typically one that wraps the connection in a filter.
+type Listener struct {
+	listener net.Listener
+	factory  func(net.Conn) (net.Conn, error)
+	// OnReject, if set, is called when the factory returns an error for a connection. The
+	// connection has already been closed, and Accept moves on to the next one.
+	OnReject func(conn net.Conn, err error)
+	closed   bool
+	mu       sync.RWMutex // Protects closed field
+}
+
+// NewListener creates a Listener that wraps each connection accepted from l using factory.
+func NewListener(l net.Listener, factory func(net.Conn) (net.Conn, error)) *Listener {
+	return &Listener{
+		listener: l,
+		factory:  factory,
+	}
+}
+
+// NewConnFilterListener creates a Listener that wraps each accepted connection in a ConnFilter.
+// The targets are validated and compiled once, here, and shared by all connections.
+func NewConnFilterListener(l net.Listener, targets, replacements []string, opts ...Option) (*Listener, error) {
+	factory, err := connFilterFactory(targets, replacements, opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(l, factory), nil
+}
+
+// NewRegexConnFilterListener creates a Listener that wraps each accepted connection in a RegexConnFilter.
+// The patterns are compiled once, here, and shared by all connections.
+func NewRegexConnFilterListener(l net.Listener, replacements []RegexReplacement, opts ...Option) (*Listener, error) {
+	factory, err := regexConnFilterFactory(replacements, opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(l, factory), nil
+}
+
+// NewFunctionConnFilterListener creates a Listener that wraps each accepted connection in a FunctionConnFilter.
+func NewFunctionConnFilterListener(l net.Listener, readFilter, writeFilter func(b []byte) ([]byte, error)) *Listener {
+	return NewListener(l, func(c net.Conn) (net.Conn, error) {
+		return NewFunctionConnFilter(c, readFilter, writeFilter)
+	})
+}
+
+// Accept implements the net.Listener Accept method. Connections rejected by the factory are
+// closed and reported to OnReject rather than returned as errors, so that servers keep serving.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		if l.isClosed() {
+			return nil, ErrListenerClosed
+		}
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if l.isClosed() {
+				return nil, ErrListenerClosed
+			}
+			return nil, err
+		}
+		filtered, err := l.factory(conn)
+		if err == nil {
+			return filtered, nil
+		}
+		conn.Close()
+		if l.OnReject != nil {
+			l.OnReject(conn, err)
+		}
+	}
+}
+
+// Close implements the net.Listener Close method. Connections already accepted stay open.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrListenerClosed
+	}
+
+	l.closed = true
+	return l.listener.Close()
+}
+
+// Addr implements the net.Listener Addr method.
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func (l *Listener) isClosed() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.closed
+}
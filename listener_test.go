@@ -0,0 +1,74 @@
+package filter
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errRejected := errors.New("rejected")
+	first := true
+	l := NewListener(inner, func(c net.Conn) (net.Conn, error) {
+		if first {
+			first = false
+			return nil, errRejected
+		}
+		return NewConnFilter(c, []string{"ping"}, []string{"pong"})
+	})
+	rejected := make(chan error, 1)
+	l.OnReject = func(conn net.Conn, err error) {
+		rejected <- err
+	}
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			c, err := net.Dial("tcp", inner.Addr().String())
+			if err != nil {
+				return
+			}
+			c.Write([]byte("ping"))
+			c.Close()
+		}
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-rejected; !errors.Is(err, errRejected) {
+		t.Errorf("OnReject got %v", err)
+	}
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "pong" {
+		t.Errorf("read %q", data)
+	}
+	conn.Close()
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Accept(); !errors.Is(err, ErrListenerClosed) {
+		t.Errorf("Accept after Close returned %v", err)
+	}
+	if err := l.Close(); !errors.Is(err, ErrListenerClosed) {
+		t.Errorf("second Close returned %v", err)
+	}
+}
+
+func TestConnFilterListenerValidates(t *testing.T) {
+	if _, err := NewConnFilterListener(nil, []string{"a"}, nil); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("got %v, want ErrInvalidFilter", err)
+	}
+	if _, err := NewRegexConnFilterListener(nil, []RegexReplacement{{Pattern: "("}}); !errors.Is(err, ErrInvalidRegexFilter) {
+		t.Errorf("got %v, want ErrInvalidRegexFilter", err)
+	}
+}
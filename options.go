@@ -0,0 +1,38 @@
+package filter
+
+// Option configures a filter created by one of the constructors in this package.
+type Option func(*options)
+
+type options struct {
+	matchKind      MatchKind
+	maxMatchLength int
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithMatchKind selects how NewConnFilter resolves targets that match at the same position.
+// The default is LeftmostLongest.
+func WithMatchKind(kind MatchKind) Option {
+	return func(o *options) {
+		o.matchKind = kind
+	}
+}
+
+// WithMaxMatchLength puts a regex filter in streaming mode, so that matches split across
+// several reads or writes are still found. n must be at least the length of the longest
+// match any of the filter's patterns can produce: up to n trailing bytes are held back and
+// rescanned together with the next chunk, and are only released once they can no longer be
+// part of a match, when the stream reaches EOF, or when the filter is flushed or closed.
+// Assertions such as \b see the bytes on both sides of a chunk boundary, and ^ and \A match
+// only at the start of the stream, so the output is the same however the stream is split.
+func WithMaxMatchLength(n int) Option {
+	return func(o *options) {
+		o.maxMatchLength = n
+	}
+}
@@ -0,0 +1,275 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrInvalidStage = errors.New("invalid pipeline stage")
+	ErrUnknownStage = errors.New("unknown pipeline stage")
+)
+
+// StageKind identifies the kind of filter a Stage builds.
+type StageKind int
+
+const (
+	// StagePair replaces target strings with replacement strings, like NewConnFilter.
+	StagePair StageKind = iota
+	// StageRegex applies regex replacements, like NewRegexReplaceConnFilter.
+	StageRegex
+	// StageFunction applies user-defined filter functions, like NewFunctionConnFilter.
+	StageFunction
+	// StageCustom wraps the connection with an arbitrary function.
+	StageCustom
+)
+
+func (k StageKind) String() string {
+	switch k {
+	case StagePair:
+		return "pair"
+	case StageRegex:
+		return "regex"
+	case StageFunction:
+		return "function"
+	case StageCustom:
+		return "custom"
+	}
+	return fmt.Sprintf("StageKind(%d)", int(k))
+}
+
+// Stage describes one filter in a Pipeline. Stages are created with PairStage, RegexStage,
+// FunctionStage or CustomStage.
+type Stage struct {
+	Name     string
+	Kind     StageKind
+	Disabled bool // Start the stage disabled
+	wrap     func(net.Conn) (net.Conn, error)
+}
+
+// PairStage describes a stage that replaces target strings with replacement strings.
+func PairStage(name string, targets, replacements []string, opts ...Option) Stage {
+	return Stage{Name: name, Kind: StagePair, wrap: func(c net.Conn) (net.Conn, error) {
+		return NewConnFilter(c, targets, replacements, opts...)
+	}}
+}
+
+// RegexStage describes a stage that applies regex replacements.
+func RegexStage(name string, replacements []RegexReplacement, opts ...Option) Stage {
+	return Stage{Name: name, Kind: StageRegex, wrap: func(c net.Conn) (net.Conn, error) {
+		return NewRegexReplaceConnFilter(c, replacements, opts...)
+	}}
+}
+
+// FunctionStage describes a stage that applies user-defined filter functions.
+func FunctionStage(name string, readFilter, writeFilter func(b []byte) ([]byte, error)) Stage {
+	return Stage{Name: name, Kind: StageFunction, wrap: func(c net.Conn) (net.Conn, error) {
+		return NewFunctionConnFilter(c, readFilter, writeFilter)
+	}}
+}
+
+// CustomStage describes a stage built by an arbitrary wrapping function, such as one of the
+// specific inspectors. Data the wrapper buffers internally is not recovered when the stage is
+// disabled.
+func CustomStage(name string, wrap func(net.Conn) (net.Conn, error)) Stage {
+	return Stage{Name: name, Kind: StageCustom, wrap: wrap}
+}
+
+// StageStats reports the state and byte counters of a pipeline stage.
+type StageStats struct {
+	Name     string
+	Kind     StageKind
+	Enabled  bool
+	ReadIn   uint64 // Bytes the stage read from the connection below it
+	ReadOut  uint64 // Bytes the stage delivered to the reader above it
+	WriteIn  uint64 // Bytes written to the stage from above
+	WriteOut uint64 // Bytes the stage wrote to the connection below it
+}
+
+// Pipeline is a net.Conn that passes data through an ordered stack of filters. The first
+// stage is closest to the parent connection: data read from the pipeline passes through the
+// stages first to last, and data written to it passes through them last to first.
+type Pipeline struct {
+	net.Conn
+	stages []*stageConn
+}
+
+// NewPipeline builds the stages around parentConn. Stage names must be non-empty and unique.
+func NewPipeline(parentConn net.Conn, stages ...Stage) (*Pipeline, error) {
+	p := &Pipeline{Conn: parentConn}
+	for _, stage := range stages {
+		if stage.Name == "" || stage.wrap == nil {
+			return nil, fmt.Errorf("%w: stages need a name and a filter", ErrInvalidStage)
+		}
+		if p.stage(stage.Name) != nil {
+			return nil, fmt.Errorf("%w: duplicate stage name %q", ErrInvalidStage, stage.Name)
+		}
+		s := &stageConn{Conn: p.Conn, name: stage.Name, kind: stage.Kind}
+		filtered, err := stage.wrap(&countingConn{Conn: p.Conn, stage: s})
+		if err != nil {
+			return nil, fmt.Errorf("stage %q: %w", stage.Name, err)
+		}
+		s.filtered = filtered
+		s.enabled.Store(!stage.Disabled)
+		s.readEnabled = !stage.Disabled
+		s.writeEnabled = !stage.Disabled
+		p.stages = append(p.stages, s)
+		p.Conn = s
+	}
+	return p, nil
+}
+
+// Enable turns the named stage on.
+func (p *Pipeline) Enable(name string) error {
+	return p.setEnabled(name, true)
+}
+
+// Disable turns the named stage off, so that data bypasses it. Data the stage has already
+// read is still delivered, and a stage holding back written data is flushed first. If the
+// stage fails to release the data it holds, the next Read returns its error.
+func (p *Pipeline) Disable(name string) error {
+	return p.setEnabled(name, false)
+}
+
+func (p *Pipeline) setEnabled(name string, enabled bool) error {
+	s := p.stage(name)
+	if s == nil {
+		return fmt.Errorf("%w: %q", ErrUnknownStage, name)
+	}
+	s.enabled.Store(enabled)
+	return nil
+}
+
+// Stats returns the state and counters of every stage, in pipeline order.
+func (p *Pipeline) Stats() []StageStats {
+	stats := make([]StageStats, len(p.stages))
+	for i, s := range p.stages {
+		stats[i] = s.stats()
+	}
+	return stats
+}
+
+// StageStats returns the state and counters of the named stage.
+func (p *Pipeline) StageStats(name string) (StageStats, error) {
+	s := p.stage(name)
+	if s == nil {
+		return StageStats{}, fmt.Errorf("%w: %q", ErrUnknownStage, name)
+	}
+	return s.stats(), nil
+}
+
+func (p *Pipeline) stage(name string) *stageConn {
+	for _, s := range p.stages {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// stageConn is one layer of a pipeline. It sends data through its filter while enabled and
+// straight to the connection below it while disabled.
+type stageConn struct {
+	net.Conn // The connection below this stage
+	name     string
+	kind     StageKind
+	filtered net.Conn
+	enabled  atomic.Bool
+
+	readIn, readOut, writeIn, writeOut atomic.Uint64
+
+	// The read and write paths each switch over on their next call after the stage is
+	// toggled, so that a filter is never used concurrently with its own draining.
+	readMu       sync.Mutex
+	readEnabled  bool
+	leftover     []byte
+	drainErr     error // Returned once the leftover has been read
+	writeMu      sync.Mutex
+	writeEnabled bool
+}
+
+func (s *stageConn) Read(b []byte) (int, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	if enabled := s.enabled.Load(); enabled != s.readEnabled {
+		s.readEnabled = enabled
+		if d, ok := s.filtered.(drainer); ok && !enabled {
+			out, err := d.drain()
+			s.leftover = append(s.leftover, out...)
+			s.drainErr = err
+		}
+	}
+	if len(s.leftover) > 0 {
+		n := copy(b, s.leftover)
+		s.leftover = s.leftover[n:]
+		s.readOut.Add(uint64(n))
+		return n, nil
+	}
+	if err := s.drainErr; err != nil {
+		s.drainErr = nil
+		return 0, fmt.Errorf("stage %q: %w", s.name, err)
+	}
+	if !s.readEnabled {
+		return s.Conn.Read(b)
+	}
+	n, err := s.filtered.Read(b)
+	s.readOut.Add(uint64(n))
+	return n, err
+}
+
+func (s *stageConn) Write(b []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if enabled := s.enabled.Load(); enabled != s.writeEnabled {
+		if f, ok := s.filtered.(interface{ Flush() error }); ok && !enabled {
+			if err := f.Flush(); err != nil {
+				return 0, err
+			}
+		}
+		s.writeEnabled = enabled
+	}
+	if !s.writeEnabled {
+		return s.Conn.Write(b)
+	}
+	n, err := s.filtered.Write(b)
+	s.writeIn.Add(uint64(n))
+	return n, err
+}
+
+// Close closes the stage's filter, which flushes it and closes the connection below.
+func (s *stageConn) Close() error {
+	return s.filtered.Close()
+}
+
+func (s *stageConn) stats() StageStats {
+	return StageStats{
+		Name:     s.name,
+		Kind:     s.kind,
+		Enabled:  s.enabled.Load(),
+		ReadIn:   s.readIn.Load(),
+		ReadOut:  s.readOut.Load(),
+		WriteIn:  s.writeIn.Load(),
+		WriteOut: s.writeOut.Load(),
+	}
+}
+
+// countingConn is the view of the connection below a stage that its filter is built on.
+type countingConn struct {
+	net.Conn
+	stage *stageConn
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stage.readIn.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stage.writeOut.Add(uint64(n))
+	return n, err
+}
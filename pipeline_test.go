@@ -0,0 +1,138 @@
+package filter
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestPipeline(t *testing.T) {
+	upper := func(b []byte) ([]byte, error) {
+		return bytes.ToUpper(b), nil
+	}
+	parent := &chunkConn{chunks: []string{"alice 1234 ", "alice 1234"}}
+	p, err := NewPipeline(parent,
+		PairStage("names", []string{"alice"}, []string{"bob"}),
+		RegexStage("digits", []RegexReplacement{{Pattern: `\d+`, Replacement: "#"}}),
+		FunctionStage("upper", upper, nil),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := p.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "BOB # " {
+		t.Errorf("first read %q", got)
+	}
+
+	if err := p.Disable("digits"); err != nil {
+		t.Fatal(err)
+	}
+	n, err = p.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "BOB 1234" {
+		t.Errorf("read with digits disabled %q", got)
+	}
+
+	if _, err := p.Write([]byte("alice 42")); err != nil {
+		t.Fatal(err)
+	}
+	if got := parent.written.String(); got != "bob 42" {
+		t.Errorf("wrote %q", got)
+	}
+
+	stats, err := p.StageStats("names")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := StageStats{Name: "names", Kind: StagePair, Enabled: true, ReadIn: 21, ReadOut: 17, WriteIn: 8, WriteOut: 6}
+	if stats != want {
+		t.Errorf("stats %+v, want %+v", stats, want)
+	}
+	if all := p.Stats(); len(all) != 3 || all[1].Enabled || all[1].ReadOut != 6 {
+		t.Errorf("unexpected pipeline stats %+v", all)
+	}
+}
+
+func TestPipelineInvalidStages(t *testing.T) {
+	if _, err := NewPipeline(&chunkConn{}, PairStage("", []string{"a"}, []string{"b"})); !errors.Is(err, ErrInvalidStage) {
+		t.Errorf("unnamed stage: got %v", err)
+	}
+	stage := PairStage("dup", []string{"a"}, []string{"b"})
+	if _, err := NewPipeline(&chunkConn{}, stage, stage); !errors.Is(err, ErrInvalidStage) {
+		t.Errorf("duplicate stage: got %v", err)
+	}
+	if _, err := NewPipeline(&chunkConn{}, RegexStage("bad", []RegexReplacement{{Pattern: "("}})); !errors.Is(err, ErrInvalidRegexFilter) {
+		t.Errorf("bad regex: got %v", err)
+	}
+	p, err := NewPipeline(&chunkConn{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Enable("missing"); !errors.Is(err, ErrUnknownStage) {
+		t.Errorf("unknown stage: got %v", err)
+	}
+}
+
+// holdLast passes data through except its last byte, which it holds until
+// the end of the stream and then fails to release.
+type holdLast struct{ held []byte }
+
+var errRelease = errors.New("cannot release held bytes")
+
+func (h *holdLast) transform(b []byte, final bool) ([]byte, error) {
+	if final {
+		return nil, errRelease
+	}
+	data := append(h.held, b...)
+	if len(data) == 0 {
+		return nil, nil
+	}
+	h.held = append([]byte(nil), data[len(data)-1:]...)
+	return data[:len(data)-1], nil
+}
+
+// holdingConn reads through a holdLast transformer.
+type holdingConn struct {
+	net.Conn
+	reader *streamReader
+}
+
+func (c *holdingConn) Read(b []byte) (int, error) { return c.reader.Read(b) }
+
+func (c *holdingConn) drain() ([]byte, error) { return c.reader.drain() }
+
+func TestPipelineDrainError(t *testing.T) {
+	parent := &chunkConn{chunks: []string{"abc", "de"}}
+	p, err := NewPipeline(parent, CustomStage("hold", func(c net.Conn) (net.Conn, error) {
+		return &holdingConn{Conn: c, reader: &streamReader{r: c, t: &holdLast{}}}, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	if n, err := p.Read(buf); err != nil || string(buf[:n]) != "a" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+
+	// The queued "b" is still delivered, and the loss of the held "c" is
+	// reported rather than passed over.
+	p.Disable("hold")
+	if n, err := p.Read(buf); err != nil || string(buf[:n]) != "b" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+	if _, err := p.Read(buf); !errors.Is(err, errRelease) {
+		t.Fatalf("got %v", err)
+	}
+	buf = make([]byte, 8)
+	if n, err := p.Read(buf); err != nil || string(buf[:n]) != "de" {
+		t.Errorf("got %q, %v", buf[:n], err)
+	}
+}
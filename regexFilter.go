@@ -1,61 +1,284 @@
 package filter
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
 	"net"
 	"regexp"
+	"sync"
+	"unicode/utf8"
 )
 
 var ErrInvalidRegexFilter = errors.New("invalid regex filter")
 
+// RegexReplacement pairs a regular expression with the template its matches are replaced with.
+// The template is expanded as by regexp.Regexp.Expand, so it may refer to submatches as $1 or ${name}.
+// An empty template deletes the matches.
+type RegexReplacement struct {
+	Pattern     string
+	Replacement string
+}
+
+// regexRule is a compiled RegexReplacement.
+type regexRule struct {
+	re       *regexp.Regexp
+	after    *regexp.Regexp // re preceded by one character of context, for streaming
+	template []byte
+}
+
 type RegexConnFilter struct {
-	FunctionConnFilter
-	match string
+	net.Conn
+	rules   []regexRule
+	reader  streamReader
+	writer  transformer
+	writeMu sync.Mutex
 }
 
-// Read reads data from the underlying connection and replaces all occurrences of target regex
-// with empty strings. The modified data is then copied back to the provided buffer.
+// Read reads data from the underlying connection and replaces all matches of the filter's
+// regular expressions. Output that does not fit in b is delivered by subsequent calls to Read.
+// In streaming mode the trailing bytes of each read are held back until more data or EOF arrives.
 func (c *RegexConnFilter) Read(b []byte) (n int, err error) {
-	n, err = c.Conn.Read(b)
+	return c.reader.Read(b)
+}
+
+// drain implements drainer.
+func (c *RegexConnFilter) drain() ([]byte, error) {
+	return c.reader.drain()
+}
+
+// Write replaces all matches of the filter's regular expressions in b and writes the result to
+// the underlying connection. It returns the number of bytes consumed from b.
+// In streaming mode the trailing bytes of b are held back until the next Write, Flush or Close.
+func (c *RegexConnFilter) Write(b []byte) (n int, err error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	out, err := c.writer.transform(b, false)
 	if err != nil {
-		return n, err
+		return 0, err
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
 	}
-	// Replace all occurrences of regex `match` with nothing
-	var buffer bytes.Buffer
-	return buffer.Len(), nil
+	return len(b), nil
 }
 
-// NewRegexConnFilter creates a new RegexConnFilter that replaces occurrences of target regex with empty strings in the data read from the connection.
-// target regex is c.match
-func (c *RegexConnFilter) ReadFilter(b []byte) ([]byte, error) {
-	if c.match == "" {
-		return b, nil
+// Flush writes any bytes held back by a streaming filter to the underlying connection.
+// It is a no-op when streaming mode is disabled.
+func (c *RegexConnFilter) Flush() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	out, err := c.writer.transform(nil, true)
+	if err != nil || len(out) == 0 {
+		return err
+	}
+	_, err = c.Conn.Write(out)
+	return err
+}
+
+// Close flushes any bytes held back by a streaming filter and closes the underlying connection.
+func (c *RegexConnFilter) Close() error {
+	ferr := c.Flush()
+	if err := c.Conn.Close(); err != nil {
+		return err
 	}
-	re := regexp.MustCompile(c.match)
-	s := re.ReplaceAllString(string(b), ``)
+	return ferr
+}
 
-	return []byte(s), nil
+// ReadFilter applies the filter's replacements, in order, to data read from the connection.
+func (c *RegexConnFilter) ReadFilter(b []byte) ([]byte, error) {
+	return applyRegexRules(c.rules, b), nil
 }
 
-// WriteFilter creates a new RegexConnFilter that replaces occurrences of target regex with empty strings in the data read from the connection.
-// target regex is c.match
+// WriteFilter applies the filter's replacements, in order, to data written to the connection.
 func (c *RegexConnFilter) WriteFilter(b []byte) ([]byte, error) {
-	if c.match == "" {
-		return b, nil
+	return applyRegexRules(c.rules, b), nil
+}
+
+// NewRegexConnFilter creates a new RegexConnFilter that replaces occurrences of target regex with empty strings in the data read from
+// and written to the connection. An empty regex leaves the data unchanged.
+// It returns an error wrapping ErrInvalidRegexFilter if regex does not compile.
+func NewRegexConnFilter(parentConn net.Conn, regex string, opts ...Option) (net.Conn, error) {
+	var rules []RegexReplacement
+	if regex != "" {
+		rules = append(rules, RegexReplacement{Pattern: regex})
 	}
-	re := regexp.MustCompile(c.match)
-	s := re.ReplaceAllString(string(b), ``)
+	return NewRegexReplaceConnFilter(parentConn, rules, opts...)
+}
 
-	return []byte(s), nil
+// NewRegexReplaceConnFilter creates a new RegexConnFilter that applies each replacement, in order, to the data read from and written to
+// the connection. The patterns are compiled once, here; it returns an error wrapping ErrInvalidRegexFilter if any of them does not compile.
+// By default each chunk is filtered on its own; WithMaxMatchLength enables streaming mode, which also finds matches split across chunks.
+func NewRegexReplaceConnFilter(parentConn net.Conn, replacements []RegexReplacement, opts ...Option) (net.Conn, error) {
+	factory, err := regexConnFilterFactory(replacements, opts)
+	if err != nil {
+		return nil, err
+	}
+	return factory(parentConn)
 }
 
-// NewRegexConnFilter creates a new RegexConnFilter that replaces occurrences of target regex with empty strings in the data read from the connection.
-// It returns an error if the lengths of target and replacement slices are not equal.
-func NewRegexConnFilter(parentConn net.Conn, regex string) (net.Conn, error) {
-	return &RegexConnFilter{
-		FunctionConnFilter: FunctionConnFilter{
-			Conn: parentConn,
-		},
+// regexConnFilterFactory compiles the patterns once, returning a function that wraps connections
+// in RegexConnFilters sharing the compiled expressions.
+func regexConnFilterFactory(replacements []RegexReplacement, opts []Option) (func(net.Conn) (net.Conn, error), error) {
+	rules, err := compileRegexRules(replacements)
+	if err != nil {
+		return nil, err
+	}
+	o := newOptions(opts)
+	return func(parentConn net.Conn) (net.Conn, error) {
+		c := &RegexConnFilter{
+			Conn:  parentConn,
+			rules: rules,
+		}
+		if o.maxMatchLength > 0 {
+			c.reader = streamReader{r: parentConn, t: newRegexStream(rules, o.maxMatchLength)}
+			c.writer = newRegexStream(rules, o.maxMatchLength)
+		} else {
+			c.reader = streamReader{r: parentConn, t: regexChunks(rules)}
+			c.writer = regexChunks(rules)
+		}
+		return c, nil
 	}, nil
 }
+
+func compileRegexRules(replacements []RegexReplacement) ([]regexRule, error) {
+	rules := make([]regexRule, 0, len(replacements))
+	for _, r := range replacements {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidRegexFilter, err)
+		}
+		after, err := regexp.Compile(`(?s:.)(?:` + r.Pattern + `)`)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidRegexFilter, err)
+		}
+		rules = append(rules, regexRule{re: re, after: after, template: []byte(r.Replacement)})
+	}
+	return rules, nil
+}
+
+func applyRegexRules(rules []regexRule, b []byte) []byte {
+	for _, r := range rules {
+		b = r.re.ReplaceAll(b, r.template)
+	}
+	return b
+}
+
+// regexChunks is a transformer that applies regex rules to each chunk on its own.
+type regexChunks []regexRule
+
+// transform implements transformer.
+func (r regexChunks) transform(b []byte, final bool) ([]byte, error) {
+	return applyRegexRules(r, b), nil
+}
+
+// regexStream is a transformer that applies regex rules across chunk boundaries. Each rule runs
+// in its own stage, fed with the output of the previous one, so that rules still apply in order.
+type regexStream []*regexStage
+
+func newRegexStream(rules []regexRule, maxLen int) regexStream {
+	s := make(regexStream, len(rules))
+	for i, r := range rules {
+		s[i] = &regexStage{rule: r, maxLen: maxLen}
+	}
+	return s
+}
+
+// transform implements transformer.
+func (s regexStream) transform(b []byte, final bool) ([]byte, error) {
+	for _, stage := range s {
+		b = stage.transform(b, final)
+	}
+	return b, nil
+}
+
+// regexStage applies a single rule to a stream. It holds back the last maxLen bytes it has seen,
+// since a match starting there might continue in the next chunk. A match that starts before that
+// window is complete, because no match is longer than maxLen. The carry also keeps the byte before
+// the window, already released, so that assertions such as \b, \B and (?m)^ see it when the window
+// is scanned again; ^ and \A only match at the start of the stream.
+type regexStage struct {
+	rule     regexRule
+	maxLen   int
+	carry    []byte
+	context  bool // carry starts with the byte before the input it holds
+	matchEnd bool // the last match ended where the held input starts
+}
+
+func (s *regexStage) transform(b []byte, final bool) []byte {
+	data := append(s.carry, b...)
+	start := 0
+	if s.context {
+		start = 1
+	}
+	cut := len(data)
+	if !final {
+		cut -= s.maxLen
+		if cut <= start {
+			s.carry = data
+			return nil
+		}
+	}
+	out := make([]byte, 0, len(data))
+	last, lastEnd := start, -1
+	if s.matchEnd {
+		lastEnd = start
+	}
+	// Matches are found one at a time, as ReplaceAll finds them, but each search keeps the byte
+	// before it as context.
+	for pos := start; pos <= len(data); {
+		m := s.find(data, pos)
+		if m == nil || m[0] >= cut && (!final || len(data) == start) {
+			// At the end of the stream, an empty match after the last byte is still replaced.
+			break
+		}
+		if m[1] > cut {
+			cut = m[1]
+		}
+		out = append(out, data[last:m[0]]...)
+		if m[1] > lastEnd {
+			// An empty match right after another match is not replaced.
+			out = s.rule.re.Expand(out, s.rule.template, data, m)
+		}
+		last, lastEnd = m[1], m[1]
+		width := 1
+		if pos < len(data) {
+			_, width = utf8.DecodeRune(data[pos:])
+		}
+		switch {
+		case pos+width > m[1]:
+			pos += width
+		case pos+1 > m[1]:
+			pos++
+		default:
+			pos = m[1]
+		}
+	}
+	out = append(out, data[last:cut]...)
+	if final {
+		s.carry, s.context, s.matchEnd = s.carry[:0], false, false
+		return out
+	}
+	s.carry = append(s.carry[:0], data[cut-1:]...)
+	s.context, s.matchEnd = true, lastEnd == cut
+	return out
+}
+
+// find returns the submatch indices of the leftmost match in data at or after pos. Past the
+// start of data, the rule is matched from the byte before pos, which its pattern is preceded by.
+func (s *regexStage) find(data []byte, pos int) []int {
+	if pos == 0 {
+		return s.rule.re.FindSubmatchIndex(data)
+	}
+	m := s.rule.after.FindSubmatchIndex(data[pos-1:])
+	if m == nil {
+		return nil
+	}
+	for i := range m {
+		if m[i] >= 0 {
+			m[i] += pos - 1
+		}
+	}
+	_, width := utf8.DecodeRune(data[m[0]:])
+	m[0] += width
+	return m
+}
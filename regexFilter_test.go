@@ -0,0 +1,128 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestRegexConnFilter(t *testing.T) {
+	parent := &chunkConn{chunks: []string{"card 4111-1111-1111-1111 from alice@example.com"}}
+	conn, err := NewRegexReplaceConnFilter(parent, []RegexReplacement{
+		{Pattern: `\d{4}-\d{4}-\d{4}-(\d{4})`, Replacement: "XXXX-$1"},
+		{Pattern: `(?P<user>\w+)@example\.com`, Replacement: "${user}@redacted.i2p"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readAll(conn, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "card XXXX-1111 from alice@redacted.i2p"; got != want {
+		t.Errorf("read %q, want %q", got, want)
+	}
+
+	n, err := conn.Write([]byte("mail bob@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len("mail bob@example.com") {
+		t.Errorf("Write returned %d", n)
+	}
+	if got, want := parent.written.String(), "mail bob@redacted.i2p"; got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
+
+func TestRegexConnFilterDeletes(t *testing.T) {
+	conn, err := NewRegexConnFilter(&chunkConn{chunks: []string{"a1b22c333"}}, `\d+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readAll(conn, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "abc" {
+		t.Errorf("got %q, want %q", got, "abc")
+	}
+}
+
+func TestRegexConnFilterInvalidPattern(t *testing.T) {
+	_, err := NewRegexConnFilter(&chunkConn{}, `(unclosed`)
+	if !errors.Is(err, ErrInvalidRegexFilter) {
+		t.Errorf("got error %v, want ErrInvalidRegexFilter", err)
+	}
+}
+
+func TestRegexConnFilterStreaming(t *testing.T) {
+	replacements := []RegexReplacement{
+		{Pattern: `\d{4}-\d{4}-\d{4}-\d{4}`, Replacement: "[card]"},
+		{Pattern: `[a-z]+@[a-z]+\.[a-z]+`, Replacement: "[email]"},
+	}
+	chunks := []string{"pay 4111-11", "11-1111-1111 now, mail ali", "ce@exam", "ple.com"}
+	parent := &chunkConn{chunks: append([]string(nil), chunks...)}
+	conn, err := NewRegexReplaceConnFilter(parent, replacements, WithMaxMatchLength(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readAll(conn, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "pay [card] now, mail [email]"; got != want {
+		t.Errorf("read %q, want %q", got, want)
+	}
+
+	for _, chunk := range chunks {
+		if _, err := conn.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := parent.written.String(), "pay [card] now, mail [email]"; got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
+
+func TestRegexConnFilterRandomSplits(t *testing.T) {
+	// Assertions must see the bytes before a window that is scanned again.
+	patterns := []string{`\bab`, `b\b`, `\Ba{1,3}`, `\bb{1,2}\b`, `(?m)^a`, `^b`, `(?m)b$`, `a?`, `(a)(b)?`}
+	rng := rand.New(rand.NewSource(1))
+	for iter := 0; iter < 1000; iter++ {
+		var replacements []RegexReplacement
+		for i := 0; i < 1+rng.Intn(3); i++ {
+			replacements = append(replacements, RegexReplacement{
+				Pattern:     patterns[rng.Intn(len(patterns))],
+				Replacement: fmt.Sprintf("<%d$1>", i),
+			})
+		}
+		b := make([]byte, 1+rng.Intn(40))
+		for i := range b {
+			b[i] = "ab \n"[rng.Intn(4)]
+		}
+		input := string(b)
+		var chunks []string
+		for rest := input; rest != ""; {
+			n := 1 + rng.Intn(len(rest))
+			chunks = append(chunks, rest[:n])
+			rest = rest[n:]
+		}
+		conn, err := NewRegexReplaceConnFilter(&chunkConn{chunks: append([]string(nil), chunks...)}, replacements, WithMaxMatchLength(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readAll(conn, 1+rng.Intn(8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules, _ := compileRegexRules(replacements)
+		if want := string(applyRegexRules(rules, []byte(input))); got != want {
+			t.Fatalf("replacements %q, chunks %q: got %q, want %q", replacements, chunks, got, want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package filter
+
+import (
+	"io"
+)
+
+// defaultReadSize is the size of the scratch buffer used to read from the
+// underlying connection when the caller's buffer is smaller than this.
+const defaultReadSize = 4096
+
+// transformer rewrites a byte stream incrementally. Each call receives the
+// next chunk of input and returns the output that is ready for delivery.
+// A transformer may retain input between calls (for instance the start of a
+// match that has not been completed yet); when final is set the stream has
+// ended and everything retained must be released. After a final call the
+// transformer is reset and may be reused.
+type transformer interface {
+	transform(b []byte, final bool) ([]byte, error)
+}
+
+// streamReader applies a transformer to everything read from r. Output that
+// does not fit in the caller's buffer is queued and delivered by subsequent
+// calls to Read, so transformations that expand the data never lose bytes.
+type streamReader struct {
+	r       io.Reader
+	t       transformer
+	buf     []byte
+	pending []byte
+	err     error
+}
+
+// Read implements io.Reader. Errors from the underlying reader are returned
+// only after all output derived from earlier data has been delivered.
+func (s *streamReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for len(s.pending) == 0 {
+		if s.err != nil {
+			err := s.err
+			s.err = nil
+			return 0, err
+		}
+		if err := s.fill(len(b)); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// fill reads the next chunk from the underlying reader and queues its
+// transformed output. io.EOF ends the stream and flushes retained input.
+// Read errors are deferred until the queue has drained; errors other than
+// io.EOF, such as deadline timeouts, leave the stream usable.
+func (s *streamReader) fill(size int) error {
+	if size < defaultReadSize {
+		size = defaultReadSize
+	}
+	if cap(s.buf) < size {
+		s.buf = make([]byte, size)
+	}
+	n, rerr := s.r.Read(s.buf[:size])
+	out, err := s.t.transform(s.buf[:n], rerr == io.EOF)
+	if err != nil {
+		return err
+	}
+	s.pending = append(s.pending, out...)
+	s.err = rerr
+	return nil
+}
+
+// drain returns every byte the reader has accepted but not yet delivered,
+// releasing anything the transformer is still holding back. If the
+// transformer fails to release its bytes, the queued output is returned with
+// the error, which tells that the bytes it held are lost.
+func (s *streamReader) drain() ([]byte, error) {
+	out, err := s.t.transform(nil, true)
+	b := append(s.pending, out...)
+	s.pending = nil
+	return b, err
+}
+
+// drainer is implemented by the filters in this package, which may hold data
+// they have read from the underlying connection but not yet returned.
+type drainer interface {
+	drain() ([]byte, error)
+}
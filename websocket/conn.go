@@ -0,0 +1,73 @@
+package websocketinspector
+
+import (
+	"net"
+	"sync"
+)
+
+// readBufferSize is the size of the buffer used to read from the underlying
+// connection.
+const readBufferSize = 32 * 1024
+
+// inspectedConn wraps a net.Conn carrying WebSocket frames to inspect the
+// messages read from and written to it.
+type inspectedConn struct {
+	net.Conn
+
+	readMu  sync.Mutex
+	reads   *frameStream
+	rbuf    []byte
+	pending []byte
+	readErr error
+
+	writeMu sync.Mutex
+	writes  *frameStream
+}
+
+// Read implements the net.Conn Read method with WebSocket inspection.
+// Frames that do not fit in b are delivered by subsequent calls.
+func (c *inspectedConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			err := c.readErr
+			c.readErr = nil
+			return 0, err
+		}
+		if c.rbuf == nil {
+			c.rbuf = make([]byte, readBufferSize)
+		}
+		n, err := c.Conn.Read(c.rbuf)
+		out, perr := c.reads.feed(c.rbuf[:n])
+		c.pending = append(c.pending, out...)
+		if perr != nil {
+			err = perr
+		}
+		c.readErr = err
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write implements the net.Conn Write method with WebSocket inspection.
+// Partial messages are held until the rest of them is written; it returns
+// the number of bytes consumed from b.
+func (c *inspectedConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	out, err := c.writes.feed(b)
+	if len(out) > 0 {
+		if _, werr := c.Conn.Write(out); werr != nil {
+			return 0, werr
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,109 @@
+package websocketinspector
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxWindow is the size of the largest LZ77 window of permessage-deflate.
+const maxWindow = 1 << 15
+
+// deflateTail completes a compressed message: the empty stored block its
+// sender stripped (RFC 7692, section 7.2.1), then a final empty block so
+// that the decompressor reports the end of the stream.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// Deflate holds the parameters of the permessage-deflate extension (RFC
+// 7692) negotiated by a WebSocket handshake. Window sizes are in bits, from
+// 8 to 15; zero stands for 15.
+type Deflate struct {
+	Enabled                 bool
+	ServerNoContextTakeover bool
+	ClientNoContextTakeover bool
+	ServerMaxWindowBits     int
+	ClientMaxWindowBits     int
+}
+
+// NegotiatedDeflate returns the permessage-deflate parameters accepted in
+// the Sec-WebSocket-Extensions header of a handshake response.
+func NegotiatedDeflate(h http.Header) Deflate {
+	for _, v := range h.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			params := strings.Split(ext, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), "permessage-deflate") {
+				continue
+			}
+			d := Deflate{Enabled: true}
+			for _, param := range params[1:] {
+				name, value, _ := strings.Cut(param, "=")
+				bits, _ := strconv.Atoi(strings.Trim(strings.TrimSpace(value), `"`))
+				switch strings.ToLower(strings.TrimSpace(name)) {
+				case "server_no_context_takeover":
+					d.ServerNoContextTakeover = true
+				case "client_no_context_takeover":
+					d.ClientNoContextTakeover = true
+				case "server_max_window_bits":
+					d.ServerMaxWindowBits = bits
+				case "client_max_window_bits":
+					d.ClientMaxWindowBits = bits
+				}
+			}
+			return d
+		}
+	}
+	return Deflate{}
+}
+
+// params returns the parameters of the compressor of the peer sending in
+// direction dir.
+func (d Deflate) params(dir Direction) (contextTakeover bool, windowBits int) {
+	contextTakeover, windowBits = !d.ServerNoContextTakeover, d.ServerMaxWindowBits
+	if dir == ClientToServer {
+		contextTakeover, windowBits = !d.ClientNoContextTakeover, d.ClientMaxWindowBits
+	}
+	if windowBits < 8 || windowBits > 15 {
+		windowBits = 15
+	}
+	return contextTakeover, windowBits
+}
+
+// inflate decompresses the payload of a message, given the data of the
+// messages its sender compressed before it, as far as the sender's context
+// reaches. It fails if the result would exceed limit bytes.
+func inflate(payload, window []byte, limit int) ([]byte, error) {
+	r := flate.NewReaderDict(io.MultiReader(bytes.NewReader(payload), bytes.NewReader(deflateTail)), window)
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProtocol, err)
+	}
+	if len(data) > limit {
+		return nil, ErrMessageTooLarge
+	}
+	return data, nil
+}
+
+// deflate compresses the data of a message for a peer whose decompressor
+// holds window.
+func deflate(data, window []byte) []byte {
+	var b bytes.Buffer
+	w, _ := flate.NewWriterDict(&b, flate.DefaultCompression, window)
+	w.Write(data)
+	w.Flush()
+	return bytes.TrimSuffix(b.Bytes(), deflateTail[:4])
+}
+
+// remember appends data to a compression context, keeping the size of the
+// largest window.
+func remember(window, data []byte) []byte {
+	window = append(window, data...)
+	if extra := len(window) - maxWindow; extra > 0 {
+		window = window[:copy(window, window[extra:])]
+	}
+	return window
+}
@@ -0,0 +1,111 @@
+package websocketinspector
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// Frame header bits.
+const (
+	finBit  = 0x80
+	rsv1Bit = 0x40 // Set on the first frame of a compressed message
+	rsvBits = 0x70
+	maskBit = 0x80
+
+	maxControlPayload = 125
+)
+
+// frameHeader is the parsed header of a WebSocket frame.
+type frameHeader struct {
+	fin    bool
+	rsv    byte
+	opcode Opcode
+	masked bool
+	mask   [4]byte
+	length int64
+}
+
+// parseFrameHeader parses the frame header at the start of b, and returns
+// its size, or 0 if more bytes are needed.
+func parseFrameHeader(b []byte) (h frameHeader, n int, err error) {
+	if len(b) < 2 {
+		return h, 0, nil
+	}
+	h.fin = b[0]&finBit != 0
+	h.rsv = b[0] & rsvBits
+	h.opcode = Opcode(b[0] & 0x0f)
+	h.masked = b[1]&maskBit != 0
+	switch h.opcode {
+	case OpContinuation, OpText, OpBinary, OpClose, OpPing, OpPong:
+	default:
+		return h, 0, fmt.Errorf("%w: reserved opcode %#x", ErrProtocol, byte(h.opcode))
+	}
+
+	n = 2
+	switch length := b[1] &^ maskBit; length {
+	case 126:
+		if len(b) < n+2 {
+			return h, 0, nil
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[n:]))
+		n += 2
+	case 127:
+		if len(b) < n+8 {
+			return h, 0, nil
+		}
+		l := binary.BigEndian.Uint64(b[n:])
+		if l>>63 != 0 {
+			return h, 0, fmt.Errorf("%w: invalid frame length", ErrProtocol)
+		}
+		h.length = int64(l)
+		n += 8
+	default:
+		h.length = int64(length)
+	}
+	if h.masked {
+		if len(b) < n+4 {
+			return h, 0, nil
+		}
+		copy(h.mask[:], b[n:])
+		n += 4
+	}
+	return h, n, nil
+}
+
+// maskBytes masks or unmasks b in place with key.
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
+
+// appendFrame appends a single final frame carrying data to b, masked with
+// a fresh key if masked is set.
+func appendFrame(b []byte, rsv byte, op Opcode, data []byte, masked bool) []byte {
+	b = append(b, finBit|rsv|byte(op))
+	var maskFlag byte
+	if masked {
+		maskFlag = maskBit
+	}
+	switch l := len(data); {
+	case l < 126:
+		b = append(b, maskFlag|byte(l))
+	case l <= 0xffff:
+		b = append(b, maskFlag|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(l))
+	default:
+		b = append(b, maskFlag|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(l))
+	}
+	if !masked {
+		return append(b, data...)
+	}
+	var key [4]byte
+	rand.Read(key[:])
+	b = append(b, key[:]...)
+	start := len(b)
+	b = append(b, data...)
+	maskBytes(key, b[start:])
+	return b
+}
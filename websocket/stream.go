@@ -0,0 +1,205 @@
+package websocketinspector
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// frameStream parses the frames flowing in one direction of a connection
+// and produces the frames to pass on in their place.
+type frameStream struct {
+	config  Config
+	deflate Deflate
+	buf     []byte
+	closed  bool // A close frame was passed on; what follows is not inspected
+
+	// The data message being reassembled, and its frames as received
+	msg *Message
+	raw []byte
+
+	// permessage-deflate contexts: the data of the compressed messages
+	// received, as seen by their sender's compressor, and of those passed
+	// on, as seen by the receiver's decompressor. They diverge once a
+	// compressed message is modified or dropped.
+	received []byte
+	sent     []byte
+	diverged bool
+}
+
+// feed parses b, following the bytes fed before, and returns the bytes to
+// pass on. Incomplete frames are held until the rest of them is fed.
+func (s *frameStream) feed(b []byte) ([]byte, error) {
+	s.buf = append(s.buf, b...)
+	var out []byte
+	for len(s.buf) > 0 {
+		if s.closed {
+			out = append(out, s.buf...)
+			s.buf = s.buf[:0]
+			break
+		}
+		h, n, err := parseFrameHeader(s.buf)
+		if err != nil {
+			return out, err
+		}
+		if n == 0 {
+			break
+		}
+		if h.length > int64(s.config.MaxMessageSize) {
+			return out, ErrMessageTooLarge
+		}
+		end := n + int(h.length)
+		if len(s.buf) < end {
+			break
+		}
+		payload := bytes.Clone(s.buf[n:end])
+		if h.masked {
+			maskBytes(h.mask, payload)
+		}
+		out, err = s.frame(out, h, s.buf[:end], payload)
+		s.buf = s.buf[:copy(s.buf, s.buf[end:])]
+		if err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+// frame handles a frame, raw as received, and appends what to pass on to
+// out.
+func (s *frameStream) frame(out []byte, h frameHeader, raw, payload []byte) ([]byte, error) {
+	dir := ServerToClient
+	if h.masked {
+		dir = ClientToServer
+	}
+	if h.opcode.IsControl() {
+		if !h.fin || h.rsv != 0 || len(payload) > maxControlPayload {
+			return out, fmt.Errorf("%w: invalid control frame", ErrProtocol)
+		}
+		if h.opcode == OpClose {
+			s.closed = true
+		}
+		return s.control(out, dir, &Message{Opcode: h.opcode, Data: payload}, raw, h.masked)
+	}
+
+	if (h.opcode == OpContinuation) != (s.msg != nil) {
+		return out, fmt.Errorf("%w: unexpected %s frame", ErrProtocol, frameKind(h.opcode))
+	}
+	if h.opcode != OpContinuation {
+		compressed := h.rsv == rsv1Bit && s.deflate.Enabled
+		if h.rsv != 0 && !compressed {
+			return out, fmt.Errorf("%w: reserved bits set", ErrProtocol)
+		}
+		s.msg = &Message{Opcode: h.opcode, Compressed: compressed}
+	} else if h.rsv != 0 {
+		return out, fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	}
+	if len(s.msg.Data)+len(payload) > s.config.MaxMessageSize {
+		return out, ErrMessageTooLarge
+	}
+	s.msg.Data = append(s.msg.Data, payload...)
+	s.raw = append(s.raw, raw...)
+	if !h.fin {
+		return out, nil
+	}
+	msg, frames := s.msg, s.raw
+	s.msg, s.raw = nil, nil
+	return s.message(out, dir, msg, frames, h.masked)
+}
+
+func frameKind(op Opcode) string {
+	if op == OpContinuation {
+		return "continuation"
+	}
+	return "data"
+}
+
+// control handles a control frame.
+func (s *frameStream) control(out []byte, dir Direction, msg *Message, raw []byte, masked bool) ([]byte, error) {
+	drop, changed, err := s.onMessage(dir, msg)
+	switch {
+	case err != nil:
+		return out, err
+	case drop:
+		return out, nil
+	case !changed:
+		return append(out, raw...), nil
+	case !msg.Opcode.IsControl() || len(msg.Data) > maxControlPayload:
+		return out, fmt.Errorf("%w: control frame", ErrInvalidModification)
+	}
+	return appendFrame(out, 0, msg.Opcode, msg.Data, masked), nil
+}
+
+// message handles a complete data message, frames as received.
+func (s *frameStream) message(out []byte, dir Direction, msg *Message, frames []byte, masked bool) ([]byte, error) {
+	contextTakeover, windowBits := s.deflate.params(dir)
+	compressed := msg.Compressed
+	if compressed {
+		var window []byte
+		if contextTakeover {
+			window = s.received
+		}
+		data, err := inflate(msg.Data, window, s.config.MaxMessageSize)
+		if err != nil {
+			return out, err
+		}
+		msg.Data = data
+		if contextTakeover {
+			s.received = remember(s.received, data)
+		}
+	}
+
+	drop, changed, err := s.onMessage(dir, msg)
+	switch {
+	case err != nil:
+		return out, err
+	case drop:
+		s.diverged = s.diverged || compressed && contextTakeover
+		return out, nil
+	case msg.Opcode != OpText && msg.Opcode != OpBinary:
+		return out, fmt.Errorf("%w: data message turned into opcode %#x", ErrInvalidModification, byte(msg.Opcode))
+	case !changed && !(compressed && s.diverged):
+		// The receiver's context is the sender's: pass the frames on as
+		// they are.
+		if compressed && contextTakeover {
+			s.sent = remember(s.sent, msg.Data)
+		}
+		return append(out, frames...), nil
+	}
+
+	if !compressed {
+		return appendFrame(out, 0, msg.Opcode, msg.Data, masked), nil
+	}
+	if !contextTakeover {
+		if windowBits == 15 || len(msg.Data) <= 1<<windowBits {
+			return appendFrame(out, rsv1Bit, msg.Opcode, deflate(msg.Data, nil), masked), nil
+		}
+		return appendFrame(out, 0, msg.Opcode, msg.Data, masked), nil
+	}
+	s.diverged = true
+	if windowBits < 15 {
+		// The compressor cannot be held to a smaller window: leave the
+		// receiver's context alone by sending the message uncompressed.
+		return appendFrame(out, 0, msg.Opcode, msg.Data, masked), nil
+	}
+	data := deflate(msg.Data, s.sent)
+	s.sent = remember(s.sent, msg.Data)
+	return appendFrame(out, rsv1Bit, msg.Opcode, data, masked), nil
+}
+
+// onMessage runs the callback on msg, and reports whether msg is to be
+// dropped, or was changed.
+func (s *frameStream) onMessage(dir Direction, msg *Message) (drop, changed bool, err error) {
+	if s.config.OnMessage == nil {
+		return false, false, nil
+	}
+	op, data := msg.Opcode, bytes.Clone(msg.Data)
+	err = s.config.OnMessage(dir, msg)
+	if errors.Is(err, ErrDropMessage) {
+		return true, true, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return false, msg.Opcode != op || !bytes.Equal(msg.Data, data), nil
+}
@@ -0,0 +1,109 @@
+// Package websocketinspector provides WebSocket (RFC 6455) message inspection
+// and modification on connections upgraded by the HTTP inspector.
+package websocketinspector
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	httpinspector "github.com/go-i2p/go-connfilter/http"
+)
+
+// Common errors returned by the inspector.
+var (
+	ErrDropMessage         = errors.New("drop WebSocket message")
+	ErrInvalidModification = errors.New("invalid WebSocket message modification")
+	ErrProtocol            = errors.New("WebSocket protocol error")
+	ErrMessageTooLarge     = errors.New("WebSocket message too large")
+)
+
+// DefaultMaxMessageSize is the size of the largest message reassembled when
+// Config.MaxMessageSize is zero.
+const DefaultMaxMessageSize = 16 << 20
+
+// Direction tells which peer sent a message.
+type Direction int
+
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	if d == ClientToServer {
+		return "client-to-server"
+	}
+	return "server-to-client"
+}
+
+// Opcode is the type of a WebSocket frame.
+type Opcode byte
+
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xa
+)
+
+// IsControl reports whether o is a control frame opcode: close, ping or pong.
+func (o Opcode) IsControl() bool {
+	return o&0x8 != 0
+}
+
+// Message is a WebSocket message: a text or binary message reassembled from
+// its frames and decompressed, or a control frame.
+type Message struct {
+	Opcode     Opcode
+	Data       []byte
+	Compressed bool // The message was sent compressed with permessage-deflate
+}
+
+// MessageCallback is called for each message. It may modify msg in place,
+// or return ErrDropMessage to drop it; other errors fail the connection.
+// Text and binary messages may be turned into one another, but not into
+// control frames, whose data is limited to 125 bytes.
+type MessageCallback func(dir Direction, msg *Message) error
+
+// Config contains the configuration for WebSocket inspection.
+type Config struct {
+	OnMessage MessageCallback
+
+	// MaxMessageSize limits the size of a reassembled message, before and
+	// after decompression. DefaultMaxMessageSize is used if it is zero.
+	MaxMessageSize int
+}
+
+// NewConn returns a connection inspecting the WebSocket frames read from and
+// written to conn, which must be past the opening handshake. deflate holds
+// the permessage-deflate parameters the handshake negotiated, if any.
+//
+// Messages are delivered whole to config.OnMessage. Messages it leaves
+// unchanged are passed on as they were framed; modified ones are re-sent as
+// a single frame, masked if the original was, and compressed again when the
+// negotiated parameters allow it. The direction of a message is told by its
+// masking: clients mask the frames they send, servers do not.
+func NewConn(conn net.Conn, config Config, deflate Deflate) net.Conn {
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = DefaultMaxMessageSize
+	}
+	c := &inspectedConn{Conn: conn}
+	c.reads = &frameStream{config: config, deflate: deflate}
+	c.writes = &frameStream{config: config, deflate: deflate}
+	return c
+}
+
+// UpgradeInspector returns a callback inspecting WebSocket connections with
+// config, for use in httpinspector.Config.UpgradeInspectors:
+//
+//	config.UpgradeInspectors = map[string]httpinspector.TunnelCallback{
+//		"websocket": websocketinspector.UpgradeInspector(wsConfig),
+//	}
+func UpgradeInspector(config Config) httpinspector.TunnelCallback {
+	return func(resp *http.Response, conn net.Conn) net.Conn {
+		return NewConn(conn, config, NegotiatedDeflate(resp.Header))
+	}
+}
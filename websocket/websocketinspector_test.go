@@ -0,0 +1,321 @@
+package websocketinspector
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	httpinspector "github.com/go-i2p/go-connfilter/http"
+)
+
+type mockConn struct {
+	net.Conn
+	readData []byte
+	readPos  int
+	written  bytes.Buffer
+}
+
+func (m *mockConn) Read(b []byte) (int, error) {
+	if m.readPos >= len(m.readData) {
+		return 0, io.EOF
+	}
+	n := copy(b, m.readData[m.readPos:])
+	m.readPos += n
+	return n, nil
+}
+
+func (m *mockConn) Write(b []byte) (int, error) {
+	return m.written.Write(b)
+}
+
+// testKey is the masking key of the frames built by tests.
+var testKey = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+// buildFrame returns a frame carrying payload, masked if masked is set.
+func buildFrame(fin bool, rsv byte, op Opcode, payload string, masked bool) []byte {
+	b := []byte{rsv | byte(op)}
+	if fin {
+		b[0] |= finBit
+	}
+	data := []byte(payload)
+	if masked {
+		b = append(b, maskBit|byte(len(data)))
+		b = append(b, testKey[:]...)
+		maskBytes(testKey, data)
+	} else {
+		b = append(b, byte(len(data)))
+	}
+	return append(b, data...)
+}
+
+type parsedFrame struct {
+	header  frameHeader
+	payload []byte
+}
+
+// parseFrames parses a sequence of frames, unmasking their payload.
+func parseFrames(t *testing.T, b []byte) []parsedFrame {
+	t.Helper()
+	var frames []parsedFrame
+	for len(b) > 0 {
+		h, n, err := parseFrameHeader(b)
+		if err != nil || n == 0 || len(b) < n+int(h.length) {
+			t.Fatalf("bad frame %q: %v", b, err)
+		}
+		payload := bytes.Clone(b[n : n+int(h.length)])
+		if h.masked {
+			maskBytes(h.mask, payload)
+		}
+		frames = append(frames, parsedFrame{h, payload})
+		b = b[n+int(h.length):]
+	}
+	return frames
+}
+
+// compressor compresses messages as a permessage-deflate peer keeping its
+// context.
+type compressor struct {
+	b bytes.Buffer
+	w *flate.Writer
+}
+
+func (c *compressor) compress(s string) string {
+	if c.w == nil {
+		c.w, _ = flate.NewWriter(&c.b, flate.BestCompression)
+	}
+	c.b.Reset()
+	c.w.Write([]byte(s))
+	c.w.Flush()
+	return strings.TrimSuffix(c.b.String(), "\x00\x00\xff\xff")
+}
+
+func TestFragmentedMessage(t *testing.T) {
+	var seen []string
+	config := Config{OnMessage: func(dir Direction, msg *Message) error {
+		seen = append(seen, fmt.Sprintf("%s %x %s", dir, byte(msg.Opcode), msg.Data))
+		if msg.Opcode == OpText {
+			msg.Data = bytes.ToUpper(msg.Data)
+		}
+		return nil
+	}}
+	ping := buildFrame(true, 0, OpPing, "p", true)
+	in := bytes.Join([][]byte{
+		buildFrame(false, 0, OpText, "hel", true),
+		ping,
+		buildFrame(false, 0, OpContinuation, "lo ", true),
+		buildFrame(true, 0, OpContinuation, "world", true),
+	}, nil)
+	conn := NewConn(&mockConn{readData: in}, config, Deflate{})
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(seen) != "[client-to-server 9 p client-to-server 1 hello world]" {
+		t.Errorf("callback saw %q", seen)
+	}
+	if !bytes.HasPrefix(out, ping) {
+		t.Errorf("ping frame not passed on as is")
+	}
+	frames := parseFrames(t, out)
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames", len(frames))
+	}
+	h := frames[1].header
+	if !h.fin || !h.masked || h.opcode != OpText || string(frames[1].payload) != "HELLO WORLD" {
+		t.Errorf("got frame %+v %q", h, frames[1].payload)
+	}
+}
+
+func TestDropMessage(t *testing.T) {
+	config := Config{OnMessage: func(dir Direction, msg *Message) error {
+		if dir != ServerToClient {
+			t.Errorf("message from %s", dir)
+		}
+		if bytes.Contains(msg.Data, []byte("secret")) {
+			return ErrDropMessage
+		}
+		return nil
+	}}
+	mc := &mockConn{}
+	conn := NewConn(mc, config, Deflate{})
+	kept := buildFrame(true, 0, OpBinary, "public", false)
+	in := append(buildFrame(true, 0, OpBinary, "secret", false), kept...)
+	// Frames are held until they are complete.
+	for i := range in {
+		if _, err := conn.Write(in[i : i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(mc.written.Bytes(), kept) {
+		t.Errorf("wrote %q", mc.written.Bytes())
+	}
+
+	_, err := conn.Write([]byte{0x8f, 0x00})
+	if err == nil {
+		t.Error("reserved opcode accepted")
+	}
+}
+
+func TestPermessageDeflate(t *testing.T) {
+	messages := []string{
+		"the quick brown fox jumps over the lazy dog",
+		"the quick brown fox jumps over the lazy dog again",
+		"the lazy dog sleeps",
+		"the quick brown fox is gone",
+	}
+	var peer compressor
+	var in []byte
+	for i, m := range messages {
+		rsv, data := byte(0), m
+		if i != 2 {
+			// Messages may also be sent uncompressed.
+			rsv, data = rsv1Bit, peer.compress(m)
+		}
+		in = append(in, buildFrame(true, rsv, OpText, data, false)...)
+	}
+
+	var seen []string
+	config := Config{OnMessage: func(dir Direction, msg *Message) error {
+		seen = append(seen, string(msg.Data))
+		if len(seen) == 2 {
+			msg.Data = []byte("the quick brown fox jumps over the dog")
+		}
+		return nil
+	}}
+	conn := NewConn(&mockConn{readData: in}, config, NegotiatedDeflate(http.Header{
+		"Sec-Websocket-Extensions": {"permessage-deflate; client_max_window_bits=10"},
+	}))
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(seen) != fmt.Sprint(messages) {
+		t.Fatalf("callback saw %q", seen)
+	}
+	first := buildFrame(true, rsv1Bit, OpText, new(compressor).compress(messages[0]), false)
+	if !bytes.HasPrefix(out, first) {
+		t.Error("unmodified message not passed on as is")
+	}
+
+	// The receiver decompresses the messages with its own context.
+	want := []string{messages[0], "the quick brown fox jumps over the dog", messages[2], messages[3]}
+	var window []byte
+	frames := parseFrames(t, out)
+	if len(frames) != len(want) {
+		t.Fatalf("got %d frames", len(frames))
+	}
+	for i, f := range frames {
+		data := f.payload
+		if f.header.rsv == rsv1Bit {
+			if data, err = inflate(data, window, DefaultMaxMessageSize); err != nil {
+				t.Fatal(err)
+			}
+			window = remember(window, data)
+		}
+		if string(data) != want[i] {
+			t.Errorf("message %d: got %q", i, data)
+		}
+	}
+}
+
+func TestNegotiatedDeflate(t *testing.T) {
+	tests := []struct {
+		header string
+		want   Deflate
+	}{
+		{"", Deflate{}},
+		{"x-webkit-deflate-frame", Deflate{}},
+		{"permessage-deflate", Deflate{Enabled: true}},
+		{
+			`permessage-deflate; server_no_context_takeover; client_max_window_bits="12"`,
+			Deflate{Enabled: true, ServerNoContextTakeover: true, ClientMaxWindowBits: 12},
+		},
+		{
+			"foo, Permessage-Deflate;client_no_context_takeover;server_max_window_bits=9",
+			Deflate{Enabled: true, ClientNoContextTakeover: true, ServerMaxWindowBits: 9},
+		},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.header != "" {
+			h.Set("Sec-WebSocket-Extensions", tt.header)
+		}
+		if got := NegotiatedDeflate(h); got != tt.want {
+			t.Errorf("%q: got %+v", tt.header, got)
+		}
+	}
+}
+
+func TestUpgradeInspector(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen []string
+	config := httpinspector.Config{UpgradeInspectors: map[string]httpinspector.TunnelCallback{
+		"websocket": UpgradeInspector(Config{OnMessage: func(dir Direction, msg *Message) error {
+			seen = append(seen, fmt.Sprintf("%s %s", dir, msg.Data))
+			msg.Data = append(msg.Data, '!')
+			return nil
+		}}),
+	}}
+	// The server echoes one message, compressed.
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Extensions: permessage-deflate\r\n\r\n")
+		head := make([]byte, 6)
+		if _, err := io.ReadFull(brw, head); err != nil {
+			t.Error(err)
+			return
+		}
+		data := make([]byte, head[1]&^maskBit)
+		io.ReadFull(brw, data)
+		maskBytes([4]byte(head[2:6]), data)
+		conn.Write(buildFrame(true, rsv1Bit, OpText, new(compressor).compress(string(data)), false))
+	})}
+	go server.Serve(httpinspector.New(l, config))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /chat HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Extensions: permessage-deflate\r\n\r\n")
+	conn.Write(buildFrame(true, 0, OpText, "hi", true))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake got %v, %v", resp, err)
+	}
+	out, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := parseFrames(t, out)
+	if len(frames) != 1 || frames[0].header.rsv != rsv1Bit {
+		t.Fatalf("got %q", out)
+	}
+	data, err := inflate(frames[0].payload, nil, DefaultMaxMessageSize)
+	if err != nil || string(data) != "hi!!" {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if fmt.Sprint(seen) != "[client-to-server hi server-to-client hi!]" {
+		t.Errorf("callback saw %q", seen)
+	}
+}